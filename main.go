@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -24,18 +27,150 @@ var (
 	dir      = f.String("dir", ".", "root directory")
 	expire   = f.Int("expire", 300, "expiration time (seconds)")
 	login    = f.String("login", "admin", "admin login")
-	password = f.String("password", "pass", "admin password")
+	password = f.String("password", "pass", "admin password (plaintext, or a bcrypt, argon2id or scrypt hash)")
+	refresh  = f.Int("refresh-expire", 86400, "refresh token expiration time (seconds, 0 to disable refresh tokens)")
+	chLimit  = f.Int("challenge-limit", 10, "maximum number of outstanding challenge data per client (0 for no limit)")
+	proxies  = f.String("trusted-proxies", "", "comma-separated addresses or CIDRs of the reverse proxies whose X-Forwarded-For header gives the client address (none if empty)")
+	reap     = f.Duration("reap-interval", time.Minute, "interval between purges of expired tokens (0 to disable)")
+	secret   = f.String("secret", "", "server secret used to hash tokens at rest (random if empty, kept in tokens.secret of the root directory with a persistent store)")
+	length   = f.Int("token-length", 32, "number of random bytes of a token")
+	encoding = f.String("token-encoding", "hex", "token encoding (hex, base64url, base32)")
+	format   = f.String("token-format", "opaque", "token format (opaque, jwt, paseto-local, paseto-public)")
+	jwtAlg   = f.String("jwt-alg", "HS256", "JWT signing algorithm (HS256, RS256, EdDSA)")
+	jwtSec   = f.String("jwt-secret", "", "JWT shared secret (HS256)")
+	jwtKey   = f.String("jwt-key", "", "JWT PEM private key file (RS256, EdDSA)")
+	jwtKeys  = f.String("jwt-keys", "", "JWT PEM private keys directory, allowing key rotation (RS256, EdDSA)")
+	pasLocal = f.String("paseto-local-key", "", "PASETO v4.local key file (32 bytes in hex)")
+	pasPub   = f.String("paseto-public-key", "", "PASETO v4.public PEM Ed25519 private key file")
+	servers  = f.String("resource-servers", "", "resource servers JSON file {\"id\":\"secret\"} allowed to introspect tokens")
+	clients  = f.String("clients", "", "clients JSON file {\"id\":{\"secret\":\"bcrypt hash\",\"lifetime\":3600}} for the client credentials grant")
+	users    = f.String("users", "", "users file (JSON, YAML, TOML or INI), users.json of the root directory if empty")
+	htpFile  = f.String("htpasswd", "", "Apache htpasswd file (bcrypt, SHA1, APR1-MD5), tried after the users file")
+	ldapConf = f.String("ldap", "", "LDAP authenticator JSON file {\"url\":\"ldap://host:389\",\"userdn\":\"uid=%s,ou=people,dc=example,dc=org\"}, tried after the users and htpasswd files")
+	revoke   = f.Bool("users-revoke", false, "revoke the tokens of the users removed or disabled")
+	scopes   = f.String("user-scopes", "", "users scopes JSON file {\"login\":[\"tokens:read\"]}, added to the permissions of the user roles")
+	storage  = f.String("store", "memory", "token store (memory, file:/path/to/tokens.db, redis://host:port/db, sqlite:/path/to/tokens.sqlite, postgres://host:port/db)")
 )
 
 // Main procedure
 func main() {
 	// Reading command-line flags
 	f.Parse(os.Args[f.NArg()+1:])
-	tokens.AddTokenUser(*login, *password)
+	if len(*users) == 0 {
+		*users = filepath.Join(*dir, "users.json")
+	}
+
+	// Commands: tokens users convert <input> <output>, tokens users scram (password read from standard input)
+	if f.NArg() > 0 {
+		switch {
+		case f.NArg() == 4 && f.Arg(0) == "users" && f.Arg(1) == "convert":
+			if err := tokens.TokensConvertUsers(f.Arg(2), f.Arg(3)); err != nil {
+				log.Fatalf("Users can't be converted: %s\n", err)
+			}
+		case f.NArg() == 2 && f.Arg(0) == "users" && f.Arg(1) == "scram":
+			password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && err != io.EOF {
+				log.Fatalf("Password can't be read: %s\n", err)
+			}
+			verifier, err := tokens.TokensSCRAMVerifier(strings.TrimRight(password, "\r\n"))
+			if err != nil {
+				log.Fatalf("Verifier can't be made: %s\n", err)
+			}
+			fmt.Println(verifier)
+		default:
+			log.Fatalf("Unknown command: %s\n", strings.Join(f.Args(), " "))
+		}
+		return
+	}
+
+	if err := tokens.TokensLoadUsers(*users); err != nil {
+		log.Fatalf("Users can't be read: %s\n", err)
+	}
+	tokens.AddTokenUser(*login, *password, tokens.RoleAdmin)
+	tokens.TokensSetUsersRevoke(*revoke)
 
 	tokens.TokensSetExpirationTime(*expire)
+	tokens.TokensSetRefreshTime(*refresh)
+	tokens.TokensSetChallengeLimit(*chLimit)
+	if len(*secret) == 0 && *storage != "" && *storage != "memory" {
+		// A persistent store needs the same secret after a restart
+		if err := tokens.TokensLoadSecret(filepath.Join(*dir, "tokens.secret")); err != nil {
+			log.Fatalf("Secret can't be read: %s\n", err)
+		}
+	} else {
+		tokens.TokensSetSecret(*secret)
+	}
+	if err := tokens.TokensSetTokenEncoding(*length, *encoding); err != nil {
+		log.Fatalf("Wrong token encoding: %s\n", err)
+	}
+	if *format == "jwt" {
+		var err error
+		if len(*jwtKeys) > 0 {
+			err = tokens.TokensLoadJWTKeys(*jwtAlg, *jwtKeys)
+		} else {
+			err = tokens.TokensSetJWT(*jwtAlg, *jwtSec, *jwtKey)
+		}
+		if err != nil {
+			log.Fatalf("Wrong JWT settings: %s\n", err)
+		}
+	}
+	if len(*pasLocal) > 0 {
+		if err := tokens.TokensSetPASETOLocalKey(*pasLocal); err != nil {
+			log.Fatalf("Wrong PASETO v4.local key: %s\n", err)
+		}
+	}
+	if len(*pasPub) > 0 {
+		if err := tokens.TokensSetPASETOPublicKey(*pasPub); err != nil {
+			log.Fatalf("Wrong PASETO v4.public key: %s\n", err)
+		}
+	}
+	if err := tokens.TokensSetTokenFormat(*format); err != nil {
+		log.Fatalf("Wrong token format: %s\n", err)
+	}
+	if len(*servers) > 0 {
+		if err := tokens.TokensLoadResourceServers(*servers); err != nil {
+			log.Fatalf("Resource servers can't be read: %s\n", err)
+		}
+	}
+	if len(*scopes) > 0 {
+		if err := tokens.TokensLoadUserScopes(*scopes); err != nil {
+			log.Fatalf("Users scopes can't be read: %s\n", err)
+		}
+	}
+	// Chain of authenticators: users file, then htpasswd file, then LDAP
+	authenticators := []tokens.Authenticator{tokens.UsersAuthenticator{}}
+	var htpasswd *tokens.HtpasswdAuthenticator
+	if len(*htpFile) > 0 {
+		var err error
+		if htpasswd, err = tokens.TokensLoadHtpasswd(*htpFile); err != nil {
+			log.Fatalf("Htpasswd file can't be read: %s\n", err)
+		}
+		authenticators = append(authenticators, htpasswd)
+	}
+	if len(*ldapConf) > 0 {
+		l, err := tokens.TokensLoadLDAP(*ldapConf)
+		if err != nil {
+			log.Fatalf("LDAP settings can't be read: %s\n", err)
+		}
+		authenticators = append(authenticators, l)
+	}
+	tokens.TokensSetAuthenticators(authenticators...)
+	if len(*clients) > 0 {
+		if err := tokens.TokensLoadClients(*clients); err != nil {
+			log.Fatalf("Clients can't be read: %s\n", err)
+		}
+	}
 
-	rand.Seed(time.Now().UnixNano())
+	// Opening the token store, expired tokens are not reloaded
+	s, err := tokens.TokensOpenStore(*storage)
+	if err != nil {
+		log.Fatalf("Store can't open: %s\n", err)
+	}
+	tokens.TokensSetStore(s)
+	tokens.TokensClean()
+	if err = tokens.TokensSyncUsers(); err != nil {
+		log.Fatalf("Users can't be synchronized: %s\n", err)
+	}
 	/* Switch to production mode
 	   - using env:   export GIN_MODE=release
 	   - using code:  gin.SetMode(gin.ReleaseMode)
@@ -43,20 +178,40 @@ func main() {
 
 	// Setting routes for api
 	router := gin.Default()
+	var trusted []string
+	if len(*proxies) > 0 {
+		trusted = strings.Split(*proxies, ",")
+	}
+	if err := router.SetTrustedProxies(trusted); err != nil {
+		log.Fatalf("Trusted proxies can't be set: %s\n", err)
+	}
 
 	// Serve alive service
 	router.GET("/alive", func(c *gin.Context) { c.JSON(200, gin.H{"status": "success", "message": "alive"}) })
 
 	TokensGroup := router.Group("/tokens")
 	{
-		TokensGroup.GET("/challengedata", tokens.TokensGetChallengeData)
 		TokensGroup.GET("/", tokens.TokensGet)             /* with auth */
 		TokensGroup.POST("/clean", tokens.TokensPostClean) /* with auth */
+		TokensGroup.GET("/.well-known/jwks.json", tokens.TokensGetJWKS)
+		TokensGroup.POST("/keys/rotate", tokens.TokensPostRotateKey) /* with auth */
 		TokensGroup.GET("/validate/:token", tokens.TokensGetValidate)
-		TokensGroup.GET("/:id", tokens.TokensGetId)       /* with auth */
-		TokensGroup.DELETE("/:id", tokens.TokensDeleteId) /* with auth */
+		TokensGroup.GET("/users", tokens.TokensGetUsers)                          /* with auth */
+		TokensGroup.POST("/users", tokens.TokensPostUser)                         /* with auth */
+		TokensGroup.GET("/users/:login", tokens.TokensGetUser)                    /* with auth */
+		TokensGroup.PUT("/users/:login", tokens.TokensPutUser)                    /* with auth */
+		TokensGroup.DELETE("/users/:login", tokens.TokensDeleteUser)              /* with auth */
+		TokensGroup.POST("/users/:login/password", tokens.TokensPostUserPassword) /* with auth */
+		TokensGroup.GET("/:id", tokens.TokensGetId)                               /* with auth */
+		TokensGroup.DELETE("/:id", tokens.TokensDeleteId)                         /* with auth */
 		TokensGroup.POST("/", tokens.TokensPost)
 		TokensGroup.POST("/auth", tokens.TokensPostAuth)
+		TokensGroup.POST("/refresh", tokens.TokensPostRefresh)
+		TokensGroup.POST("/scram/start", tokens.TokensPostSCRAMStart)
+		TokensGroup.POST("/scram/finish", tokens.TokensPostSCRAMFinish)
+		TokensGroup.POST("/introspect", tokens.TokensPostIntrospect) /* with resource server auth */
+		TokensGroup.POST("/revoke", tokens.TokensPostRevoke)
+		TokensGroup.POST("/oauth/token", tokens.TokensPostOAuthToken) /* with client auth */
 		TokensGroup.GET("/admin.html", func(c *gin.Context) { c.File(*dir + "/admin.html") })
 	}
 
@@ -84,19 +239,38 @@ func main() {
 	log.Println("Starting server " + *addr + " with expiration date at " + strconv.Itoa(*expire) + " seconds")
 
 	// Starting
+	stopReaper := tokens.TokensStartReaper(*reap)
+	stopWatcher, err := tokens.TokensWatchUsers()
+	if err != nil {
+		log.Fatalf("Users file can't be watched: %s\n", err)
+	}
+	stopHtpasswd := func() {}
+	if htpasswd != nil {
+		if stopHtpasswd, err = htpasswd.Watch(); err != nil {
+			log.Fatalf("Htpasswd file can't be watched: %s\n", err)
+		}
+	}
 	go func() {
-		if err := router.Run(*addr); err != nil {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server can't start: %s\n", err)
 		}
 	}()
 
 	// Wait for interrupt signal to gracefully shutdown the server with
 	// a timeout of 5 seconds.
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscall.SIGTERM
 	// kill -2 is syscall.SIGINT
 	// kill -9 is syscall.SIGKILL but can't be catch, so don't need add it
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	// kill -1 (SIGHUP) reloads the users file
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			tokens.TokensReloadUsers()
+		}
+	}()
 	<-quit
 	log.Println("Shutting down server...")
 
@@ -107,6 +281,12 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatal("Server forced to shutdown:", err)
 	}
+	stopReaper()
+	stopWatcher()
+	stopHtpasswd()
+	if closer, ok := s.(io.Closer); ok {
+		closer.Close()
+	}
 
 	log.Println("Server exiting")
 }
@@ -0,0 +1,95 @@
+package tokens
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+/* Errors returned by the authenticators
+ * - ErrUnauthorized: unknown user or wrong password, the next authenticator of the chain is tried
+ * - ErrUserDisabled: the user is known but disabled, the chain stops
+ */
+var (
+	ErrUnauthorized = errors.New("Unauthorized")
+	ErrUserDisabled = errors.New("User disabled")
+)
+
+/* An authenticator checks the password of a user, and returns its roles (the user role if empty) */
+type Authenticator interface {
+	Authenticate(login, password string) ([]string, error)
+}
+
+/* The users list authenticator (users file, -login user, SQL store), see tokenUsers */
+type UsersAuthenticator struct{}
+
+func (UsersAuthenticator) Authenticate(login, password string) ([]string, error) {
+	user, found := getTokenUser(login)
+	if !found {
+		return nil, ErrUnauthorized
+	}
+	if user.Disabled {
+		log.Println("Disabled user " + login)
+		return nil, ErrUserDisabled
+	}
+	if !checkPassword(login, user, password) {
+		return nil, ErrUnauthorized
+	}
+	return user.Roles, nil
+}
+
+/* The chain of authenticators, tried in order */
+var authenticators = struct {
+	sync.RWMutex
+	list []Authenticator
+}{list: []Authenticator{UsersAuthenticator{}}}
+
+/* Set the chain of authenticators of POST /tokens and POST /tokens/auth, the users list only by default */
+func TokensSetAuthenticators(list ...Authenticator) {
+	authenticators.Lock()
+	authenticators.list = list
+	authenticators.Unlock()
+}
+
+/* The source of the users of an authenticator, recorded in their tokens: empty for the users list
+ * A user of a source does not own the tokens of a user of another source with the same login
+ */
+func authenticatorSource(a Authenticator) string {
+	switch a.(type) {
+	case UsersAuthenticator:
+		return ""
+	case *HtpasswdAuthenticator:
+		return "htpasswd"
+	case *LDAPAuthenticator:
+		return "ldap"
+	}
+	return fmt.Sprintf("%T", a)
+}
+
+/* Authenticate a user with the chain of authenticators, the first one accepting the password wins
+ * The roles are those given by the winning authenticator, never those of a user of the users list with the same login
+ * source is the source of the winning authenticator (see authenticatorSource), empty for the users list
+ */
+func authenticate(login, password string) (roles []string, source string, ok bool) {
+	if len(login) == 0 || len(password) == 0 {
+		return nil, "", false
+	}
+	authenticators.RLock()
+	list := authenticators.list
+	authenticators.RUnlock()
+	for _, a := range list {
+		roles, err := a.Authenticate(login, password)
+		if err == nil {
+			return roles, authenticatorSource(a), true
+		}
+		if err == ErrUserDisabled {
+			break
+		}
+		if err != ErrUnauthorized {
+			log.Println("Authentication error for user " + login + ": " + err.Error())
+		}
+	}
+	log.Println("Authentication failed for user " + login)
+	return nil, "", false
+}
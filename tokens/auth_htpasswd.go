@@ -0,0 +1,101 @@
+package tokens
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gotokens/tools"
+)
+
+/* The Apache htpasswd file authenticator, user:hash lines with bcrypt ($2y$), SHA1 ({SHA}) or Apache MD5 ($apr1$) hashes
+ * Its users only get the user role (and their -user-scopes), even if a user of the users file has the same login
+ * The file is reloaded on change (see Watch)
+ */
+type HtpasswdAuthenticator struct {
+	sync.RWMutex
+	file  string
+	users map[string]string
+}
+
+/* Load an htpasswd file */
+func TokensLoadHtpasswd(file string) (*HtpasswdAuthenticator, error) {
+	h := &HtpasswdAuthenticator{file: file}
+	return h, h.Reload()
+}
+
+/* Read and check an htpasswd file, the entries with an unsupported hash (crypt, plaintext) are ignored */
+func readHtpasswd(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, errors.New("Wrong line " + strconv.Itoa(n) + " of " + file)
+		}
+		login, hash := line[:i], line[i+1:]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") && !strings.HasPrefix(hash, "$apr1$") {
+			log.Println("Unsupported htpasswd hash for user " + login + ", only bcrypt, SHA1 and APR1-MD5 are supported")
+			continue
+		}
+		users[login] = hash
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, errors.New("No user in " + file)
+	}
+	return users, nil
+}
+
+/* Reload the htpasswd file, the current users are kept if the file can not be read */
+func (h *HtpasswdAuthenticator) Reload() error {
+	users, err := readHtpasswd(h.file)
+	if err != nil {
+		log.Println("Htpasswd file " + h.file + " not reloaded: " + err.Error())
+		return err
+	}
+	h.Lock()
+	h.users = users
+	h.Unlock()
+	log.Println("Htpasswd file " + h.file + " reloaded")
+	return nil
+}
+
+/* Watch the htpasswd file and reload it on change
+ * The returned function stops the watcher and waits for its end
+ */
+func (h *HtpasswdAuthenticator) Watch() (stop func(), err error) {
+	return watchFile(h.file, h.Reload)
+}
+
+func (h *HtpasswdAuthenticator) Authenticate(login, password string) ([]string, error) {
+	h.RLock()
+	hash, found := h.users[login]
+	h.RUnlock()
+	if !found {
+		return nil, ErrUnauthorized
+	}
+	ok, err := tools.CheckHtpasswdHash(hash, password)
+	if err != nil {
+		log.Println("Wrong htpasswd hash for user " + login + ": " + err.Error())
+	}
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+	return []string{RoleUser}, nil
+}
@@ -0,0 +1,93 @@
+package tokens
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/* An htpasswd user gets the user role and its own scopes, not the roles of a user of the users file with the same login */
+func TestHtpasswdRoles(t *testing.T) {
+	setTestUsers(t, "", map[string]USER{"admin": {Password: "adminpass", Roles: []string{RoleAdmin}}})
+	userScopes.Lock()
+	previous := userScopes.scopes
+	userScopes.scopes = map[string][]string{"admin": {ScopeTokensClean}}
+	userScopes.Unlock()
+	defer func() {
+		userScopes.Lock()
+		userScopes.scopes = previous
+		userScopes.Unlock()
+	}()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("htpass"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), ".htpasswd")
+	if err = os.WriteFile(file, []byte("admin:"+string(hash)+"\nbob:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := TokensLoadHtpasswd(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestAuthenticators(t, UsersAuthenticator{}, h)
+
+	code, item := postTokens(t, "admin", "htpass")
+	if code != http.StatusCreated {
+		t.Fatalf("Htpasswd user refused: %d", code)
+	}
+	sort.Strings(item.Scopes)
+	if strings.Join(item.Scopes, " ") != "tokens:clean tokens:delete tokens:read" {
+		t.Fatalf("Htpasswd user scopes: %v", item.Scopes)
+	}
+	if len(item.RefreshToken) > 0 {
+		t.Fatal("Refresh token given to an htpasswd user")
+	}
+	if code, _ = postTokens(t, "admin", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("Wrong password: %d", code)
+	}
+
+	/* A user removed from the file can not authenticate anymore */
+	if err = os.WriteFile(file, []byte("admin:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ = postTokens(t, "bob", "htpass"); code != http.StatusUnauthorized {
+		t.Fatalf("Removed htpasswd user: %d", code)
+	}
+}
+
+/* The APR1-MD5 and SHA1 hashes of htpasswd (openssl passwd -apr1, htpasswd -s) */
+func TestHtpasswdHashes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ".htpasswd")
+	lines := "apr:$apr1$ZzG3wnXB$Kl.GPk8K/KmiOapSNxdyq.\n" +
+		"apr2:$apr1$r31.....$ARC3pREO82RIm0aQ2zszC0\n" +
+		"sha:{SHA}fwfw8odIXDmGA4ioj8iWXfJz4Fg=\n" +
+		"sha2:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	if err := os.WriteFile(file, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := TokensLoadHtpasswd(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for login, password := range map[string]string{"apr": "htpass", "apr2": "password", "sha": "htpass", "sha2": "password"} {
+		if _, err = h.Authenticate(login, password); err != nil {
+			t.Fatalf("%s refused: %v", login, err)
+		}
+		if _, err = h.Authenticate(login, password+"x"); err != ErrUnauthorized {
+			t.Fatalf("%s: wrong password: %v", login, err)
+		}
+	}
+	if source := authenticatorSource(h); source != "htpasswd" {
+		t.Fatalf("Source %q", source)
+	}
+}
@@ -0,0 +1,245 @@
+package tokens
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gotokens/tools"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+/* The LDAP (or Active Directory) authenticator
+ * - bind-as-user: the user DN is built from a template, "uid=%s,ou=people,dc=example,dc=org" or "%s@example.org" (AD)
+ * - search-then-bind: the user DN is searched with a filter "(uid=%s)", with the service account BindDN if set
+ * The roles come from the groups of the user, read from its memberOf attribute, or searched with a group filter "(member=%s)"
+ */
+type LDAPAuthenticator struct {
+	URL      string `json:"url"`      /* ldap://host:389 or ldaps://host:636 */
+	StartTLS bool   `json:"starttls"` /* upgrade a ldap:// connection to TLS */
+	CAFile   string `json:"cafile"`   /* PEM certificate authorities, the system ones if empty */
+	Insecure bool   `json:"insecure"` /* skip the verification of the server certificate (tests only) */
+	Timeout  int    `json:"timeout"`  /* in seconds, 10 if null */
+	/* bind-as-user */
+	UserDN string `json:"userdn"`
+	/* search-then-bind */
+	BindDN       string `json:"binddn"`
+	BindPassword string `json:"bindpassword"`
+	BaseDN       string `json:"basedn"`
+	UserFilter   string `json:"userfilter"`
+	/* group-to-role mapping: map[group DN] => role */
+	GroupBaseDN string            `json:"groupbasedn"` /* BaseDN if empty */
+	GroupFilter string            `json:"groupfilter"` /* "(member=%s)" with the user DN (not an AD bind name), memberOf attribute of the user if empty */
+	Roles       map[string]string `json:"roles"`
+
+	tlsConfig *tls.Config
+}
+
+/* Load the LDAP authenticator settings from a JSON file
+ * {"url":"ldap://host:389","starttls":true,"basedn":"dc=example,dc=org","userfilter":"(uid=%s)","roles":{"cn=admins,ou=groups,dc=example,dc=org":"admin"}}
+ */
+func TokensLoadLDAP(file string) (*LDAPAuthenticator, error) {
+	l := &LDAPAuthenticator{}
+	if err := tools.ReadFromJSONFile(file, l); err != nil {
+		return nil, err
+	}
+	return l, l.init()
+}
+
+/* Check the settings, and prepare the TLS configuration */
+func (l *LDAPAuthenticator) init() error {
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return errors.New("Unsupported LDAP URL " + l.URL)
+	}
+	if len(l.UserDN) == 0 && len(l.UserFilter) == 0 {
+		return errors.New("LDAP needs a user DN template (bind-as-user) or a user filter (search-then-bind)")
+	}
+	if len(l.UserFilter) > 0 && len(l.BaseDN) == 0 {
+		return errors.New("LDAP user filter needs a base DN")
+	}
+	for group, role := range l.Roles {
+		if !validRole(role) {
+			return errors.New("Unknown role " + role + " for group " + group)
+		}
+	}
+	if l.Timeout <= 0 {
+		l.Timeout = 10
+	}
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+	}
+	l.tlsConfig = &tls.Config{ServerName: host, InsecureSkipVerify: l.Insecure}
+	if len(l.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(l.CAFile)
+		if err != nil {
+			return err
+		}
+		l.tlsConfig.RootCAs = x509.NewCertPool()
+		if !l.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("No certificate in " + l.CAFile)
+		}
+	}
+	return nil
+}
+
+/* Connect to the directory, with StartTLS if asked */
+func (l *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	timeout := time.Duration(l.Timeout) * time.Second
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}), ldap.DialWithTLSConfig(l.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if l.StartTLS {
+		if err = conn.StartTLS(l.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+/* Escape a value of a DN (RFC 4514) */
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(",+\"\\<>;=", r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(value)-1 && r == ' ':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r == 0:
+			b.WriteString("\\00")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+/* Authenticate a user with a bind, then read its groups to get its roles */
+func (l *LDAPAuthenticator) Authenticate(login, password string) ([]string, error) {
+	/* An empty password is an unauthenticated bind, always successful */
+	if len(login) == 0 || len(password) == 0 {
+		return nil, ErrUnauthorized
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var dn string
+	var groups []string
+	if len(l.UserFilter) > 0 {
+		/* search-then-bind */
+		if len(l.BindDN) > 0 {
+			if err = conn.Bind(l.BindDN, l.BindPassword); err != nil {
+				return nil, err
+			}
+		}
+		result, err := conn.Search(ldap.NewSearchRequest(l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, l.Timeout, false,
+			fmt.Sprintf(l.UserFilter, ldap.EscapeFilter(login)), []string{"memberOf"}, nil))
+		if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, err
+		}
+		if result == nil || len(result.Entries) != 1 {
+			return nil, ErrUnauthorized
+		}
+		dn = result.Entries[0].DN
+		groups = result.Entries[0].GetAttributeValues("memberOf")
+		if err = conn.Bind(dn, password); err != nil {
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+				return nil, ErrUnauthorized
+			}
+			return nil, err
+		}
+	} else {
+		/* bind-as-user */
+		dn = fmt.Sprintf(l.UserDN, escapeDN(login))
+		if err = conn.Bind(dn, password); err != nil {
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+				return nil, ErrUnauthorized
+			}
+			return nil, err
+		}
+	}
+	if len(l.Roles) == 0 {
+		return nil, nil
+	}
+
+	if len(l.GroupFilter) > 0 {
+		groups, err = l.searchGroups(conn, dn)
+	} else if len(l.UserFilter) == 0 {
+		groups, err = l.memberOf(conn, dn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var roles []string
+	for _, group := range groups {
+		for g, role := range l.Roles {
+			if strings.EqualFold(g, group) && !hasScope(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles, nil
+}
+
+/* Search the groups of a user DN with the group filter, with the service account if set */
+func (l *LDAPAuthenticator) searchGroups(conn *ldap.Conn, dn string) ([]string, error) {
+	if len(l.BindDN) > 0 {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+	base := l.GroupBaseDN
+	if len(base) == 0 {
+		base = l.BaseDN
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, l.Timeout, false,
+		fmt.Sprintf(l.GroupFilter, ldap.EscapeFilter(dn)), []string{"1.1"}, nil))
+	if err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
+
+/* Read the memberOf attribute of a user bound as itself
+ * An Active Directory bind name (user@domain) is not a DN, the user is then searched by its userPrincipalName under BaseDN
+ */
+func (l *LDAPAuthenticator) memberOf(conn *ldap.Conn, dn string) ([]string, error) {
+	base, scope, filter := dn, ldap.ScopeBaseObject, "(objectClass=*)"
+	if !strings.Contains(dn, "=") {
+		if len(l.BaseDN) == 0 {
+			return nil, errors.New("LDAP needs a base DN to read the groups of " + dn)
+		}
+		base, scope, filter = l.BaseDN, ldap.ScopeWholeSubtree, "(userPrincipalName="+ldap.EscapeFilter(dn)+")"
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(base, scope, ldap.NeverDerefAliases, 1, l.Timeout, false, filter, []string{"memberOf"}, nil))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, nil
+	}
+	return result.Entries[0].GetAttributeValues("memberOf"), nil
+}
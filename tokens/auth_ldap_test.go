@@ -0,0 +1,305 @@
+package tokens
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+/* An entry of the test directory, with a password if a bind is allowed */
+type ldapEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+var ldapTestEntries = []ldapEntry{
+	{"uid=alice,ou=people,dc=example,dc=org", "alicepass", map[string][]string{"uid": {"alice"}, "memberOf": {"cn=admins,ou=groups,dc=example,dc=org"}}},
+	{"uid=bob,ou=people,dc=example,dc=org", "bobpass", map[string][]string{"uid": {"bob"}}},
+	{"uid=dup,ou=people,dc=example,dc=org", "duppass", map[string][]string{"uid": {"dup"}}},
+	{"uid=dup,ou=other,dc=example,dc=org", "duppass", map[string][]string{"uid": {"dup"}}},
+	{"cn=service,dc=example,dc=org", "servicepass", nil},
+	{"cn=admins,ou=groups,dc=example,dc=org", "", map[string][]string{"member": {"uid=alice,ou=people,dc=example,dc=org"}}},
+	{"cn=operators,ou=groups,dc=example,dc=org", "", map[string][]string{"member": {"uid=alice,ou=people,dc=example,dc=org", "uid=bob,ou=people,dc=example,dc=org"}}},
+}
+
+/* A minimal in-process LDAP server: simple bind, search (and, or, equality and present filters), StartTLS
+ * With requireTLS, the binds are refused until StartTLS
+ */
+type ldapTestServer struct {
+	listener   net.Listener
+	cert       tls.Certificate
+	requireTLS bool
+}
+
+/* Start a test LDAP server, its URL is returned with the PEM file of its self-signed certificate */
+func newLDAPTestServer(t *testing.T, requireTLS bool) (url string, caFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "127.0.0.1"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), IsCA: true, BasicConstraintsValid: true}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile = filepath.Join(t.TempDir(), "ca.pem")
+	if err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ldapTestServer{listener: listener, cert: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, requireTLS: requireTLS}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return "ldap://" + listener.Addr().String(), caFile
+}
+
+/* An LDAP result (bind, search done, extended) */
+func ldapResult(id int64, tag ber.Tag, code int64) []byte {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	packet.AppendChild(result)
+	return packet.Bytes()
+}
+
+/* A search result entry, with the asked attributes */
+func ldapSearchEntry(id int64, entry ldapEntry, attributes []*ber.Packet) []byte {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "")
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, ""))
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for _, attribute := range attributes {
+		for name, values := range entry.attrs {
+			if !strings.EqualFold(name, attribute.Data.String()) {
+				continue
+			}
+			a := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, value := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+			}
+			a.AppendChild(set)
+			list.AppendChild(a)
+		}
+	}
+	result.AppendChild(list)
+	packet.AppendChild(result)
+	return packet.Bytes()
+}
+
+/* Test if an entry matches a search filter */
+func ldapMatch(entry ldapEntry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case 0: /* and */
+		for _, child := range filter.Children {
+			if !ldapMatch(entry, child) {
+				return false
+			}
+		}
+		return true
+	case 1: /* or */
+		for _, child := range filter.Children {
+			if ldapMatch(entry, child) {
+				return true
+			}
+		}
+		return false
+	case 3: /* equality */
+		for name, values := range entry.attrs {
+			if strings.EqualFold(name, filter.Children[0].Data.String()) {
+				for _, value := range values {
+					if strings.EqualFold(value, filter.Children[1].Data.String()) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	case 7: /* present */
+		return strings.EqualFold(filter.Data.String(), "objectClass")
+	}
+	return false
+}
+
+func (s *ldapTestServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	secure := false
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case 0: /* bind */
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+			code := int64(49) /* invalid credentials */
+			for _, entry := range ldapTestEntries {
+				if strings.EqualFold(entry.dn, dn) && len(entry.password) > 0 && entry.password == password {
+					code = 0
+				}
+			}
+			if s.requireTLS && !secure {
+				code = 13 /* confidentiality required */
+			}
+			conn.Write(ldapResult(id, 1, code))
+		case 2: /* unbind */
+			return
+		case 3: /* search */
+			base, scope, size := op.Children[0].Data.String(), op.Children[1].Value.(int64), op.Children[3].Value.(int64)
+			code, n := int64(0), int64(0)
+			for _, entry := range ldapTestEntries {
+				found := strings.HasSuffix(strings.ToLower(entry.dn), strings.ToLower(base))
+				if scope == 0 {
+					found = strings.EqualFold(entry.dn, base)
+				}
+				if !found || !ldapMatch(entry, op.Children[6]) {
+					continue
+				}
+				if size > 0 && n >= size {
+					code = 4 /* size limit exceeded */
+					break
+				}
+				n++
+				conn.Write(ldapSearchEntry(id, entry, op.Children[7].Children))
+			}
+			conn.Write(ldapResult(id, 5, code))
+		case 23: /* extended, StartTLS */
+			conn.Write(ldapResult(id, 24, 0))
+			server := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{s.cert}})
+			if err = server.Handshake(); err != nil {
+				return
+			}
+			conn, secure = server, true
+		default:
+			return
+		}
+	}
+}
+
+func testLDAPRoles(t *testing.T, l *LDAPAuthenticator, login, password string, expected ...string) {
+	roles, err := l.Authenticate(login, password)
+	if err != nil {
+		t.Fatalf("%s: %v", login, err)
+	}
+	sort.Strings(roles)
+	if strings.Join(roles, ",") != strings.Join(expected, ",") {
+		t.Fatalf("%s: roles %v, expected %v", login, roles, expected)
+	}
+}
+
+func testLDAPUnauthorized(t *testing.T, l *LDAPAuthenticator, login, password string) {
+	if _, err := l.Authenticate(login, password); err != ErrUnauthorized {
+		t.Fatalf("%s: %v, expected ErrUnauthorized", login, err)
+	}
+}
+
+var ldapTestRoles = map[string]string{"cn=admins,ou=groups,dc=example,dc=org": RoleAdmin, "cn=operators,ou=groups,dc=example,dc=org": RoleOperator}
+
+func TestLDAPBindAsUser(t *testing.T) {
+	url, _ := newLDAPTestServer(t, false)
+	l := &LDAPAuthenticator{URL: url, UserDN: "uid=%s,ou=people,dc=example,dc=org", Roles: ldapTestRoles}
+	if err := l.init(); err != nil {
+		t.Fatal(err)
+	}
+	/* The roles come from the memberOf attribute of the user */
+	testLDAPRoles(t, l, "alice", "alicepass", RoleAdmin)
+	testLDAPRoles(t, l, "bob", "bobpass")
+	testLDAPUnauthorized(t, l, "alice", "wrong")
+	testLDAPUnauthorized(t, l, "alice", "")
+	testLDAPUnauthorized(t, l, "nobody", "alicepass")
+	testLDAPUnauthorized(t, l, "alice,ou=people", "alicepass")
+
+	/* The roles come from a search of the groups */
+	l.GroupFilter, l.BaseDN = "(member=%s)", "dc=example,dc=org"
+	testLDAPRoles(t, l, "alice", "alicepass", RoleAdmin, RoleOperator)
+	testLDAPRoles(t, l, "bob", "bobpass", RoleOperator)
+}
+
+func TestLDAPSearchThenBind(t *testing.T) {
+	url, _ := newLDAPTestServer(t, false)
+	l := &LDAPAuthenticator{URL: url, BindDN: "cn=service,dc=example,dc=org", BindPassword: "servicepass",
+		BaseDN: "dc=example,dc=org", UserFilter: "(uid=%s)", Roles: ldapTestRoles}
+	if err := l.init(); err != nil {
+		t.Fatal(err)
+	}
+	/* The roles come from the memberOf attribute of the user */
+	testLDAPRoles(t, l, "alice", "alicepass", RoleAdmin)
+	testLDAPRoles(t, l, "bob", "bobpass")
+	testLDAPUnauthorized(t, l, "bob", "wrong")
+	testLDAPUnauthorized(t, l, "nobody", "bobpass")
+	testLDAPUnauthorized(t, l, "*", "bobpass")
+	/* A login matching several entries is refused */
+	testLDAPUnauthorized(t, l, "dup", "duppass")
+
+	/* The roles come from a search of the groups, under the group base DN */
+	l.GroupFilter, l.GroupBaseDN = "(member=%s)", "ou=groups,dc=example,dc=org"
+	testLDAPRoles(t, l, "alice", "alicepass", RoleAdmin, RoleOperator)
+	testLDAPRoles(t, l, "bob", "bobpass", RoleOperator)
+
+	/* A wrong service account is an error, not a wrong password */
+	l.BindPassword = "wrong"
+	if _, err := l.Authenticate("alice", "alicepass"); err == nil || err == ErrUnauthorized {
+		t.Fatalf("Wrong service account: %v", err)
+	}
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	url, caFile := newLDAPTestServer(t, true)
+	l := &LDAPAuthenticator{URL: url, StartTLS: true, CAFile: caFile, UserDN: "uid=%s,ou=people,dc=example,dc=org", Roles: ldapTestRoles}
+	if err := l.init(); err != nil {
+		t.Fatal(err)
+	}
+	testLDAPRoles(t, l, "alice", "alicepass", RoleAdmin)
+	testLDAPUnauthorized(t, l, "alice", "wrong")
+
+	/* The server certificate is checked */
+	l = &LDAPAuthenticator{URL: url, StartTLS: true, UserDN: "uid=%s,ou=people,dc=example,dc=org"}
+	if err := l.init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Authenticate("alice", "alicepass"); err == nil || err == ErrUnauthorized {
+		t.Fatalf("Unknown server certificate: %v", err)
+	}
+	/* Without StartTLS, the server refuses the bind */
+	l = &LDAPAuthenticator{URL: url, UserDN: "uid=%s,ou=people,dc=example,dc=org"}
+	if err := l.init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Authenticate("alice", "alicepass"); err == nil || err == ErrUnauthorized {
+		t.Fatalf("Bind without StartTLS: %v", err)
+	}
+}
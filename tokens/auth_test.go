@@ -0,0 +1,182 @@
+package tokens
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* An authenticator of tests, with a single user */
+type testAuthenticator struct {
+	login, password string
+	roles           []string
+}
+
+func (a testAuthenticator) Authenticate(login, password string) ([]string, error) {
+	if login != a.login || password != a.password {
+		return nil, ErrUnauthorized
+	}
+	return a.roles, nil
+}
+
+/* Set a test chain of authenticators, the previous one is restored at the end of the test */
+func setTestAuthenticators(t *testing.T, list ...Authenticator) {
+	authenticators.Lock()
+	previous := authenticators.list
+	authenticators.Unlock()
+	TokensSetAuthenticators(list...)
+	t.Cleanup(func() { TokensSetAuthenticators(previous...) })
+}
+
+/* Post credentials to POST /tokens */
+func postTokens(t *testing.T, login, password string) (int, TOKEN) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	body, _ := json.Marshal(INPUTCREDENTIALS{Login: login, Password: password})
+	c.Request = httptest.NewRequest(http.MethodPost, "/tokens", bytes.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	TokensPost(c)
+	var item TOKEN
+	if w.Code == http.StatusCreated {
+		if err := json.Unmarshal(w.Body.Bytes(), &item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, item
+}
+
+/* The roles of an external user are those of its authenticator, not those of a local user with the same login */
+func TestAuthenticateExternalRoles(t *testing.T) {
+	setTestUsers(t, "", map[string]USER{"admin": {Password: "adminpass", Roles: []string{RoleAdmin}}})
+	setTestAuthenticators(t, UsersAuthenticator{}, testAuthenticator{login: "admin", password: "ldappass"})
+
+	code, item := postTokens(t, "admin", "ldappass")
+	if code != http.StatusCreated {
+		t.Fatalf("External user refused: %d", code)
+	}
+	if hasScope(item.Scopes, ScopeUsersManage) || hasScope(item.Scopes, ScopeTokensAll) || !hasScope(item.Scopes, ScopeTokensRead) {
+		t.Fatalf("External user scopes: %v", item.Scopes)
+	}
+	if code, item = postTokens(t, "admin", "adminpass"); code != http.StatusCreated || !hasScope(item.Scopes, ScopeUsersManage) {
+		t.Fatalf("Local user: %d %v", code, item.Scopes)
+	}
+	if code, _ = postTokens(t, "admin", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("Wrong password: %d", code)
+	}
+
+	/* The roles given by the authenticator are kept */
+	setTestAuthenticators(t, UsersAuthenticator{}, testAuthenticator{login: "bob", password: "ldappass", roles: []string{RoleOperator}})
+	if roles, source, ok := authenticate("bob", "ldappass"); !ok || len(source) == 0 || len(roles) != 1 || roles[0] != RoleOperator {
+		t.Fatalf("Authenticator roles: %v %q %v", roles, source, ok)
+	}
+}
+
+/* An external user gets no refresh token, a refresh token of a user missing from the users list is refused */
+func TestExternalUserRefresh(t *testing.T) {
+	setTestUsers(t, "", map[string]USER{"alice": {Password: "alicepass"}})
+	setTestAuthenticators(t, UsersAuthenticator{}, testAuthenticator{login: "bob", password: "ldappass"})
+
+	if code, item := postTokens(t, "bob", "ldappass"); code != http.StatusCreated || len(item.RefreshToken) > 0 {
+		t.Fatalf("External user: %d, refresh token %q", code, item.RefreshToken)
+	}
+	code, item := postTokens(t, "alice", "alicepass")
+	if code != http.StatusCreated || len(item.RefreshToken) == 0 {
+		t.Fatalf("Local user: %d, refresh token %q", code, item.RefreshToken)
+	}
+	if code, _ = postRefresh(t, item.RefreshToken); code != http.StatusCreated {
+		t.Fatalf("Refresh of a local user: %d", code)
+	}
+
+	item, err := generateTokens("bob", "", "10.0.0.1", "family", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ = postRefresh(t, item.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("Refresh of a user missing from the users list: %d", code)
+	}
+}
+
+/* Post a refresh token to POST /tokens/refresh */
+func postRefresh(t *testing.T, token string) (int, TOKEN) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	body, _ := json.Marshal(INPUTREFRESH{RefreshToken: token})
+	c.Request = httptest.NewRequest(http.MethodPost, "/tokens/refresh", bytes.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	TokensPostRefresh(c)
+	var item TOKEN
+	if w.Code == http.StatusCreated {
+		if err := json.Unmarshal(w.Body.Bytes(), &item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, item
+}
+
+/* A refresh only keeps the scopes still allowed by the current roles of the user */
+func TestRefreshDemotedUser(t *testing.T) {
+	setTestUsers(t, "", map[string]USER{"alice": {Password: "alicepass", Roles: []string{RoleAdmin}}})
+	setTestAuthenticators(t, UsersAuthenticator{})
+
+	code, item := postTokens(t, "alice", "alicepass")
+	if code != http.StatusCreated || !hasScope(item.Scopes, ScopeUsersManage) {
+		t.Fatalf("Admin: %d %v", code, item.Scopes)
+	}
+	tokenUsers.Lock()
+	tokenUsers.users["alice"] = USER{Password: "alicepass", Roles: []string{RoleUser}}
+	tokenUsers.Unlock()
+
+	code, item = postRefresh(t, item.RefreshToken)
+	if code != http.StatusCreated {
+		t.Fatalf("Refresh of a demoted user: %d", code)
+	}
+	if hasScope(item.Scopes, ScopeUsersManage) || hasScope(item.Scopes, ScopeTokensAll) || !hasScope(item.Scopes, ScopeTokensRead) {
+		t.Fatalf("Scopes of a demoted user: %v", item.Scopes)
+	}
+}
+
+/* An external user does not own the tokens of a user of the users list with the same login */
+func TestTokenOwnershipSource(t *testing.T) {
+	setTestStore(t)
+	setTestUsers(t, "", map[string]USER{"admin": {Password: "adminpass", Roles: []string{RoleOperator}}})
+	setTestAuthenticators(t, UsersAuthenticator{}, testAuthenticator{login: "admin", password: "ldappass"})
+
+	code, local := postTokens(t, "admin", "adminpass")
+	if code != http.StatusCreated || len(local.Source) > 0 {
+		t.Fatalf("Local user: %d %q", code, local.Source)
+	}
+	code, external := postTokens(t, "admin", "ldappass")
+	if code != http.StatusCreated || len(external.Source) == 0 {
+		t.Fatalf("External user: %d %q", code, external.Source)
+	}
+	if ids := listTokenIds(t, external.Token); len(ids) != 1 || !ids[external.Id] {
+		t.Fatalf("Tokens of the external user: %v", ids)
+	}
+	if ids := listTokenIds(t, local.Token); ids[external.Id] {
+		t.Fatalf("Tokens of the local user: %v", ids)
+	}
+	if w := callWithToken(t, TokensGetId, http.MethodGet, "/tokens/"+local.Id, external.Token, local.Id); w.Code != http.StatusNotFound {
+		t.Fatalf("Token of the local user read by the external user: %d", w.Code)
+	}
+	if w := callWithToken(t, TokensDeleteId, http.MethodDelete, "/tokens/"+local.Id, external.Token, local.Id); w.Code != http.StatusNotFound {
+		t.Fatalf("Token of the local user deleted by the external user: %d", w.Code)
+	}
+
+	/* The source is kept by the stateless tokens */
+	setTestJWTKeys(t, testSigningKey("kid", time.Now().Unix()))
+	tokenFormat = "jwt"
+	item, err := generateTokens("admin", "ldap", "10.0.0.1", "family", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, _, _, err := validateStateless(item.Token); err != nil || claims.Source != "ldap" {
+		t.Fatalf("Source of a JWT: %+v %v", claims, err)
+	}
+}
@@ -0,0 +1,77 @@
+package tokens
+
+import (
+	"errors"
+	"log"
+
+	"gotokens/tools"
+)
+
+/* Errors returned when a challenge data can not be used */
+var (
+	ErrChallengeReplayed = errors.New("Challenge data already used")
+	ErrChallengeAddress  = errors.New("Challenge data bound to another client")
+	ErrChallengeLimit    = errors.New("Too many challenge data")
+)
+
+/* Maximum number of outstanding challenge data per client address: unused and not expired (0 for no limit) */
+var challengeLimit int = 10
+
+func TokensSetChallengeLimit(n int) {
+	challengeLimit = n
+}
+
+/* Create a new challenge data bound to a client address
+ * ErrChallengeLimit if the client has too many outstanding challenge data
+ */
+func createChallenge(data, address string) (CHALLENGEDATA, error) {
+	now := tools.Epoch()
+	if challengeLimit > 0 {
+		n, err := store.CountChallenges(address, now-int64(expireTime))
+		if err != nil {
+			return CHALLENGEDATA{}, err
+		}
+		if n >= challengeLimit {
+			log.Println("Too many challenge data for client " + address)
+			return CHALLENGEDATA{}, ErrChallengeLimit
+		}
+	}
+	item := CHALLENGEDATA{
+		Id:      tools.Genuuid(),
+		Data:    data,
+		Created: now,
+		Address: address,
+	}
+	return item, store.CreateChallenge(item)
+}
+
+/* Use a challenge data: it is removed from the store, so that it can only be used once
+ * The store keeps a tombstone of the used challenge data until it expires, to tell a replay from an unknown challenge data
+ * - ErrChallengeReplayed: the challenge data was already used
+ * - ErrChallengeAddress: the challenge data was created for another client address, it is kept
+ * - ErrNotFound: unknown or expired challenge data
+ */
+func useChallenge(id, address string) (CHALLENGEDATA, error) {
+	item, err := store.GetChallenge(id)
+	if err == ErrChallengeReplayed {
+		log.Println("Challenge data " + id + " replayed by client " + address)
+	}
+	if err != nil {
+		return item, err
+	}
+	if item.Address != address {
+		log.Println("Challenge data " + id + " of client " + item.Address + " used by client " + address)
+		return item, ErrChallengeAddress
+	}
+	if err = store.DeleteChallenge(id); err == ErrChallengeReplayed || err == ErrNotFound {
+		/* Used meanwhile by a concurrent request */
+		log.Println("Challenge data " + id + " replayed by client " + address)
+		return item, ErrChallengeReplayed
+	} else if err != nil {
+		return item, err
+	}
+	if item.Created < tools.Epoch()-int64(expireTime) {
+		return item, ErrNotFound
+	}
+	return item, nil
+}
@@ -0,0 +1,105 @@
+package tokens
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"gotokens/tools"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* The client properties (client credentials grant) */
+type CLIENT struct {
+	Secret   string   `json:"secret"`             /* bcrypt hash of the client secret */
+	Lifetime int64    `json:"lifetime,omitempty"` /* token lifetime in seconds, the expiration time if null */
+	Scopes   []string `json:"scopes,omitempty"`   /* the scopes the client is allowed to get */
+}
+
+/* The clients registry : map[id] => client */
+var tokenClients = struct {
+	sync.RWMutex
+	clients map[string]CLIENT
+}{clients: make(map[string]CLIENT)}
+
+/* A bcrypt hash checked for an unknown client, so the response time does not tell which clients exist */
+const dummyClientSecret = "$2a$10$hTAAnUQJ6kELCxkjoZXKM.x/B0AESQ3w1HWt1ltCY4cNbmhkBQeje"
+
+/* Load the clients registry from a JSON file {"id":{"secret":"$2a$...","lifetime":3600},...}
+ * Client secrets must be bcrypt hashes
+ */
+func TokensLoadClients(file string) error {
+	clients := make(map[string]CLIENT)
+	if err := tools.ReadFromJSONFile(file, &clients); err != nil {
+		return err
+	}
+	for id, client := range clients {
+		if !tools.IsBCRYPTHash(client.Secret) {
+			return errors.New("Secret of client " + id + " is not a bcrypt hash")
+		}
+	}
+	tokenClients.Lock()
+	tokenClients.clients = clients
+	tokenClients.Unlock()
+	return nil
+}
+
+/* Test the client credentials of the request, and return the client */
+func testClient(c *gin.Context) (string, CLIENT, bool) {
+	id, secret := clientCredentials(c)
+	if len(id) == 0 {
+		return "", CLIENT{}, false
+	}
+	tokenClients.RLock()
+	client, found := tokenClients.clients[id]
+	tokenClients.RUnlock()
+	if !found {
+		tools.BCRYPTCheckPassword(dummyClientSecret, secret)
+		return id, CLIENT{}, false
+	}
+	if !tools.BCRYPTCheckPassword(client.Secret, secret) {
+		return id, CLIENT{}, false
+	}
+	return id, client, true
+}
+
+/* Issue an access token (POST /oauth/token) with form-encoded grant_type=client_credentials
+ * and optional requested scopes (scope=tokens:read), all the allowed scopes by default
+ * with client auth (basic auth or client_id/client_secret)
+ * 400 -> Wrong parameter or unsupported grant type
+ * 401 -> Wrong client credentials
+ * 200 -> Ok, {"access_token":"...","token_type":"Bearer","expires_in":3600,"scope":"..."}
+ */
+func TokensPostOAuthToken(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	grant := c.PostForm("grant_type")
+	if len(grant) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": "Missing grant type", "error": "invalid_request"})
+		return
+	}
+	if grant != "client_credentials" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": "Unsupported grant type", "error": "unsupported_grant_type"})
+		return
+	}
+	id, client, ok := testClient(c)
+	if !ok {
+		log.Println("Client authentication failed for client " + id)
+		c.Writer.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized", "error": "invalid_client"})
+		return
+	}
+	scopes := grantScopes(parseScopes(c.PostForm("scope")), client.Scopes)
+	item, err := GenerateClientToken(id, client.Lifetime, scopes, clientAddress(c))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": item.Token,
+		"token_type":   "Bearer",
+		"expires_in":   item.ExpiresAt(int64(expireTime)) - item.Created,
+		"scope":        formatScopes(item.Scopes),
+	})
+}
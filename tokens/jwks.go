@@ -0,0 +1,88 @@
+package tokens
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* A JSON web key (public part only) */
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+/* Convert a verification key to a JSON web key, symmetric keys are never published */
+func publicJWK(key *signingKey) (JWK, bool) {
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: key.kid,
+			Use: "sig",
+			Alg: key.method.Alg(),
+			N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Kid: key.kid,
+			Use: "sig",
+			Alg: key.method.Alg(),
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(public),
+		}, true
+	}
+	return JWK{}, false
+}
+
+/* Get the verification keys (GET /.well-known/jwks.json)
+ * no auth
+ * 200 -> Ok, the active and previous keys
+ */
+func TokensGetJWKS(c *gin.Context) {
+	keys := []JWK{}
+	jwtKeys.RLock()
+	if jwtKeys.active != nil {
+		if jwk, ok := publicJWK(jwtKeys.active); ok {
+			keys = append(keys, jwk)
+		}
+	}
+	for i := len(jwtKeys.previous) - 1; i >= 0; i-- {
+		if jwk, ok := publicJWK(jwtKeys.previous[i]); ok {
+			keys = append(keys, jwk)
+		}
+	}
+	jwtKeys.RUnlock()
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+/* Rotate the signing key (POST /keys/rotate)
+ * with auth, scope keys:rotate
+ * 401 -> Unauthorized
+ * 403 -> Missing scope
+ * 409 -> No keys directory
+ * 201 -> New key created
+ */
+func TokensPostRotateKey(c *gin.Context) {
+	if _, ok := testTokenScope(c, ScopeKeysRotate); !ok {
+		return
+	}
+	kid, err := TokensRotateJWTKey()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"status": "succeeded", "message": "Key rotated", "kid": kid})
+}
@@ -0,0 +1,321 @@
+package tokens
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gotokens/tools"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+/* The claims of a signed token */
+type TokenClaims struct {
+	Address string `json:"addr,omitempty"`
+	Client  string `json:"client_id,omitempty"`
+	Source  string `json:"src,omitempty"`
+	Scope   string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+/* A JWT signing key */
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+	created int64
+	retired int64 /* 0 while the key is active */
+	expires int64 /* the latest expiration date of the tokens signed with the key */
+	loaded  int64 /* the tokens signed before this date are not tracked (keys read from the directory), null if none */
+}
+
+/* The JWT keys: the active one signs, the previous ones still verify until their tokens expire */
+var jwtKeys struct {
+	sync.RWMutex
+	alg      string
+	dir      string
+	active   *signingKey
+	previous []*signingKey
+}
+
+/* Test if the JWT signing key is set */
+func jwtKeyReady() bool {
+	jwtKeys.RLock()
+	defer jwtKeys.RUnlock()
+	return jwtKeys.active != nil
+}
+
+/* Read a PEM private key for the algorithm (RS256 or EdDSA) */
+func parseSigningKey(alg string, content []byte) (*signingKey, error) {
+	switch alg {
+	case "RS256":
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(content)
+		if err != nil {
+			return nil, err
+		}
+		return &signingKey{method: jwt.SigningMethodRS256, private: key, public: key.Public()}, nil
+	case "EdDSA":
+		key, err := jwt.ParseEdPrivateKeyFromPEM(content)
+		if err != nil {
+			return nil, err
+		}
+		return &signingKey{method: jwt.SigningMethodEdDSA, private: key, public: key.(crypto.Signer).Public()}, nil
+	}
+	return nil, errors.New("Unknown JWT algorithm " + alg)
+}
+
+/* Set the JWT signing method and key
+ * - alg: HS256 (with secret), RS256 or EdDSA (with keyFile, a PEM private key)
+ */
+func TokensSetJWT(alg, secret, keyFile string) error {
+	var key *signingKey
+	if alg == "HS256" {
+		if len(secret) == 0 {
+			return errors.New("HS256 needs a shared secret")
+		}
+		key = &signingKey{method: jwt.SigningMethodHS256, private: []byte(secret), public: []byte(secret)}
+	} else {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		if key, err = parseSigningKey(alg, content); err != nil {
+			return err
+		}
+		key.kid = strings.TrimSuffix(filepath.Base(keyFile), filepath.Ext(keyFile))
+	}
+	key.created = tools.Epoch()
+	jwtKeys.Lock()
+	defer jwtKeys.Unlock()
+	jwtKeys.alg = alg
+	jwtKeys.dir = ""
+	jwtKeys.active = key
+	jwtKeys.previous = nil
+	return nil
+}
+
+/* Load the JWT keys from a directory of PEM private keys (<kid>.pem)
+ * - alg: RS256 or EdDSA
+ * The most recent key is the active one, each older key is retired when the next one was created
+ * A first key is generated if the directory is empty
+ */
+func TokensLoadJWTKeys(alg, dir string) error {
+	if alg != "RS256" && alg != "EdDSA" {
+		return errors.New("Key directory needs RS256 or EdDSA algorithm")
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	var keys []*signingKey
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		key, err := parseSigningKey(alg, content)
+		if err != nil {
+			return errors.New(file + ": " + err.Error())
+		}
+		key.kid = strings.TrimSuffix(filepath.Base(file), ".pem")
+		key.created = info.ModTime().Unix()
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].created < keys[j].created })
+	now := tools.Epoch()
+	for i, key := range keys {
+		key.loaded = now
+		if i < len(keys)-1 {
+			key.retired = keys[i+1].created
+			key.loaded = key.retired
+		}
+	}
+	jwtKeys.Lock()
+	jwtKeys.alg = alg
+	jwtKeys.dir = dir
+	jwtKeys.active = nil
+	jwtKeys.previous = nil
+	if len(keys) > 0 {
+		jwtKeys.active = keys[len(keys)-1]
+		jwtKeys.previous = keys[:len(keys)-1]
+	}
+	jwtKeys.Unlock()
+	pruneJWTKeys(now)
+	if len(keys) == 0 {
+		_, err = TokensRotateJWTKey()
+		return err
+	}
+	log.Println("Loaded " + tools.I64toa(int64(len(keys))) + " JWT keys, active key " + jwtKeys.active.kid)
+	return nil
+}
+
+/* Generate a new active key in the keys directory, the current active key is kept to verify its tokens
+ * Return the new key id
+ */
+func TokensRotateJWTKey() (string, error) {
+	jwtKeys.Lock()
+	defer jwtKeys.Unlock()
+	if len(jwtKeys.dir) == 0 {
+		return "", errors.New("No JWT keys directory")
+	}
+	alg := jwtKeys.alg
+	var private crypto.Signer
+	var err error
+	if alg == "RS256" {
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	content := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	key, err := parseSigningKey(alg, content)
+	if err != nil {
+		return "", err
+	}
+	now := tools.Epoch()
+	key.kid = time.Unix(now, 0).UTC().Format("20060102150405") + "-" + tools.Genuuid()[:8]
+	key.created = now
+	if err = ioutil.WriteFile(filepath.Join(jwtKeys.dir, key.kid+".pem"), content, 0600); err != nil {
+		return "", err
+	}
+	if jwtKeys.active != nil {
+		jwtKeys.active.retired = now
+		jwtKeys.previous = append(jwtKeys.previous, jwtKeys.active)
+	}
+	jwtKeys.active = key
+	log.Println("Rotate JWT key, active key " + key.kid)
+	return key.kid, nil
+}
+
+/* The longest lifetime of a token: the expiration time, or the lifetime of a client if longer */
+func maxTokenLifetime() int64 {
+	lifetime := int64(expireTime)
+	tokenClients.RLock()
+	defer tokenClients.RUnlock()
+	for _, client := range tokenClients.clients {
+		if client.Lifetime > lifetime {
+			lifetime = client.Lifetime
+		}
+	}
+	return lifetime
+}
+
+/* Remove the retired keys whose tokens have all expired
+ * The tokens signed before the keys were read from the directory may live as long as the longest token lifetime
+ */
+func pruneJWTKeys(now int64) {
+	lifetime := maxTokenLifetime()
+	jwtKeys.Lock()
+	defer jwtKeys.Unlock()
+	var kept []*signingKey
+	for _, key := range jwtKeys.previous {
+		expires := key.expires
+		if key.loaded > 0 && key.loaded+lifetime > expires {
+			expires = key.loaded + lifetime
+		}
+		if expires < now {
+			log.Println("Remove JWT key " + key.kid)
+			if len(jwtKeys.dir) > 0 {
+				os.Remove(filepath.Join(jwtKeys.dir, key.kid+".pem"))
+			}
+		} else {
+			kept = append(kept, key)
+		}
+	}
+	jwtKeys.previous = kept
+}
+
+/* Sign a token item with the active key, the key is kept until the token expires */
+func generateJWT(item TOKEN) (string, error) {
+	expires := item.ExpiresAt(int64(expireTime))
+	jwtKeys.Lock()
+	key := jwtKeys.active
+	if key != nil && key.expires < expires {
+		key.expires = expires
+	}
+	jwtKeys.Unlock()
+	if key == nil {
+		return "", errors.New("JWT signing key is not set")
+	}
+	claims := TokenClaims{
+		Address: item.Address,
+		Client:  item.Client,
+		Source:  item.Source,
+		Scope:   formatScopes(item.Scopes),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        item.Id,
+			Subject:   item.User,
+			IssuedAt:  jwt.NewNumericDate(time.Unix(item.Created, 0)),
+			ExpiresAt: jwt.NewNumericDate(time.Unix(expires, 0)),
+		},
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	if len(key.kid) > 0 {
+		token.Header["kid"] = key.kid
+	}
+	return token.SignedString(key.private)
+}
+
+/* Find the verification key of a signed token from its kid header */
+func verificationKey(kid string) (*signingKey, error) {
+	jwtKeys.RLock()
+	defer jwtKeys.RUnlock()
+	if jwtKeys.active != nil && jwtKeys.active.kid == kid {
+		return jwtKeys.active, nil
+	}
+	for _, key := range jwtKeys.previous {
+		if key.kid == kid {
+			return key, nil
+		}
+	}
+	return nil, errors.New("Unknown JWT key " + kid)
+}
+
+/* Check the signature and expiry of a signed token, and return its claims */
+func validateJWT(token string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := verificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		if t.Method.Alg() != key.method.Alg() {
+			return nil, errors.New("Unexpected JWT algorithm " + t.Method.Alg())
+		}
+		return key.public, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+/* Test if a token value looks like a JWT (header.payload.signature) */
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
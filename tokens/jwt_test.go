@@ -0,0 +1,87 @@
+package tokens
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+/* Set test JWT keys, the previous keys are restored at the end of the test */
+func setTestJWTKeys(t *testing.T, active *signingKey, previous ...*signingKey) {
+	jwtKeys.Lock()
+	alg, dir, a, p := jwtKeys.alg, jwtKeys.dir, jwtKeys.active, jwtKeys.previous
+	jwtKeys.alg, jwtKeys.dir, jwtKeys.active, jwtKeys.previous = "HS256", "", active, previous
+	jwtKeys.Unlock()
+	t.Cleanup(func() {
+		jwtKeys.Lock()
+		jwtKeys.alg, jwtKeys.dir, jwtKeys.active, jwtKeys.previous = alg, dir, a, p
+		jwtKeys.Unlock()
+	})
+}
+
+func testSigningKey(kid string, created int64) *signingKey {
+	return &signingKey{kid: kid, method: jwt.SigningMethodHS256, private: []byte(kid), public: []byte(kid), created: created}
+}
+
+func previousKids() []string {
+	jwtKeys.RLock()
+	defer jwtKeys.RUnlock()
+	kids := []string{}
+	for _, key := range jwtKeys.previous {
+		kids = append(kids, key.kid)
+	}
+	return kids
+}
+
+/* A retired key is kept until the longest-lived token signed with it expires */
+func TestPruneJWTKeys(t *testing.T) {
+	now := int64(1000000)
+	old := testSigningKey("old", now-10)
+	setTestJWTKeys(t, old)
+	if _, err := generateJWT(TOKEN{Id: "id1", Created: now, Updated: now}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := generateJWT(TOKEN{Id: "id2", Created: now, Updated: now, Client: "app", Lifetime: 3600}); err != nil {
+		t.Fatal(err)
+	}
+	if old.expires != now+3600 {
+		t.Fatalf("Key expires at %d, expected %d", old.expires, now+3600)
+	}
+
+	old.retired = now
+	setTestJWTKeys(t, testSigningKey("new", now), old)
+	pruneJWTKeys(now + int64(expireTime) + 1)
+	if kids := previousKids(); len(kids) != 1 {
+		t.Fatalf("Key removed before its client token expired: %v", kids)
+	}
+	pruneJWTKeys(now + 3601)
+	if kids := previousKids(); len(kids) != 0 {
+		t.Fatalf("Key kept after its tokens expired: %v", kids)
+	}
+}
+
+/* The tokens signed before the keys were read are expected to live as long as the longest client lifetime */
+func TestPruneLoadedJWTKeys(t *testing.T) {
+	now := int64(1000000)
+	tokenClients.Lock()
+	clients := tokenClients.clients
+	tokenClients.clients = map[string]CLIENT{"app": {Lifetime: 7200}}
+	tokenClients.Unlock()
+	defer func() {
+		tokenClients.Lock()
+		tokenClients.clients = clients
+		tokenClients.Unlock()
+	}()
+
+	old := testSigningKey("old", now-10)
+	old.retired, old.loaded = now, now
+	setTestJWTKeys(t, testSigningKey("new", now), old)
+	pruneJWTKeys(now + 3600)
+	if kids := previousKids(); len(kids) != 1 {
+		t.Fatalf("Loaded key removed before the client lifetime: %v", kids)
+	}
+	pruneJWTKeys(now + 7201)
+	if kids := previousKids(); len(kids) != 0 {
+		t.Fatalf("Loaded key kept after the client lifetime: %v", kids)
+	}
+}
@@ -0,0 +1,167 @@
+package tokens
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"sync"
+
+	"gotokens/tools"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* The resource servers allowed to introspect tokens : map[id] => secret */
+var resourceServers = struct {
+	sync.RWMutex
+	secrets map[string]string
+}{secrets: make(map[string]string)}
+
+/* Load the resource servers from a JSON file {"id":"secret",...} */
+func TokensLoadResourceServers(file string) error {
+	secrets := make(map[string]string)
+	if err := tools.ReadFromJSONFile(file, &secrets); err != nil {
+		return err
+	}
+	resourceServers.Lock()
+	resourceServers.secrets = secrets
+	resourceServers.Unlock()
+	return nil
+}
+
+func AddResourceServer(id, secret string) {
+	resourceServers.Lock()
+	resourceServers.secrets[id] = secret
+	resourceServers.Unlock()
+}
+
+/* Get the client credentials from basic auth or from the form (client_id, client_secret) */
+func clientCredentials(c *gin.Context) (string, string) {
+	if id, secret, ok := c.Request.BasicAuth(); ok {
+		return id, secret
+	}
+	return c.PostForm("client_id"), c.PostForm("client_secret")
+}
+
+/* Test the resource server credentials of the request */
+func testResourceServer(c *gin.Context) (string, bool) {
+	id, secret := clientCredentials(c)
+	if len(id) == 0 {
+		return "", false
+	}
+	resourceServers.RLock()
+	expected, found := resourceServers.secrets[id]
+	resourceServers.RUnlock()
+	if !found || subtle.ConstantTimeCompare([]byte(expected), []byte(secret)) != 1 {
+		return id, false
+	}
+	return id, true
+}
+
+/* The introspection response (RFC 7662) */
+type INTROSPECTION struct {
+	Active   bool   `json:"active"`
+	Sub      string `json:"sub,omitempty"`
+	Exp      int64  `json:"exp,omitempty"`
+	Iat      int64  `json:"iat,omitempty"`
+	ClientId string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+/* Find an active token from its value, and return it with its expiration date */
+func activeToken(token string) (TOKEN, int64, bool) {
+	if item, exp, stateless, err := validateStateless(token); stateless {
+		return item, exp, err == nil
+	}
+	item, err := store.GetByValue(hashToken(token))
+	if err != nil || item.Used > 0 || tokenExpired(item, tools.Epoch()) {
+		return TOKEN{}, 0, false
+	}
+	return item, item.ExpiresAt(int64(expireTime)), true
+}
+
+/* Introspect a token (POST /introspect) with form-encoded token
+ * with resource server auth (basic auth or client_id/client_secret)
+ * 400 -> Wrong parameter
+ * 401 -> Unauthorized
+ * 200 -> Ok, {"active":false} for an invalid, expired or unknown token
+ */
+func TokensPostIntrospect(c *gin.Context) {
+	id, ok := testResourceServer(c)
+	if !ok {
+		log.Println("Introspection refused for resource server " + id)
+		c.Writer.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized"})
+		return
+	}
+	token := c.PostForm("token")
+	if len(token) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": "Missing token"})
+		return
+	}
+	item, exp, active := activeToken(token)
+	if !active {
+		c.JSON(http.StatusOK, INTROSPECTION{Active: false})
+		return
+	}
+	c.JSON(http.StatusOK, INTROSPECTION{
+		Active:   true,
+		Sub:      item.User,
+		Exp:      exp,
+		Iat:      item.Created,
+		ClientId: item.Client,
+		Scope:    formatScopes(item.Scopes),
+	})
+}
+
+/* Revoke a token (POST /revoke) with form-encoded token, following RFC 7009
+ * no auth, holding the token is enough to revoke it
+ * with client auth (basic auth or client_id/client_secret), a client only revokes its own tokens
+ * A refresh token revokes its whole family
+ * A stateless token (JWT, PASETO) can not be revoked, it stays valid until it expires
+ * 400 -> Wrong parameter, or token of another client
+ * 401 -> Wrong client credentials
+ * 200 -> Revoked, or invalid, unknown or stateless token (RFC 7009 2.2)
+ */
+func TokensPostRevoke(c *gin.Context) {
+	token := c.PostForm("token")
+	if len(token) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": "Missing token", "error": "invalid_request"})
+		return
+	}
+	client := ""
+	if id, _ := clientCredentials(c); len(id) > 0 {
+		if _, _, ok := testClient(c); !ok {
+			log.Println("Client authentication failed for client " + id)
+			c.Writer.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized", "error": "invalid_client"})
+			return
+		}
+		client = id
+	}
+	item, _, stateless, err := validateStateless(token)
+	if !stateless {
+		item, err = store.GetByValue(hashToken(token))
+	}
+	if err == nil && len(client) > 0 && item.Client != client {
+		log.Println("Token " + item.Id + " of user " + item.User + " not revoked for client " + client)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": "Token of another client", "error": "unauthorized_client"})
+		return
+	}
+	if stateless {
+		c.JSON(http.StatusOK, gin.H{"status": "succeeded", "message": "Stateless token, not revoked"})
+		return
+	}
+	if err == nil && item.Refresh {
+		err = revokeFamily(item.Family)
+	} else if err == nil {
+		if err = store.Delete(item.Id); err == nil {
+			log.Println("Revoke token " + item.Id + " for user " + item.User)
+		}
+	}
+	if err != nil && err != ErrNotFound {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "succeeded", "message": "Revoked"})
+}
@@ -0,0 +1,196 @@
+package tokens
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/* Post a form to a handler, with basic auth if user is set */
+func postForm(t *testing.T, handler gin.HandlerFunc, path string, form url.Values, user, password string) (int, map[string]interface{}) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(user) > 0 {
+		c.Request.SetBasicAuth(user, password)
+	}
+	handler(c)
+	body := make(map[string]interface{})
+	if w.Body.Len() > 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, body
+}
+
+/* Set test clients and resource servers, the previous ones are restored at the end of the test */
+func setTestClients(t *testing.T, clients map[string]CLIENT, servers map[string]string) {
+	tokenClients.Lock()
+	previousClients := tokenClients.clients
+	tokenClients.clients = clients
+	tokenClients.Unlock()
+	resourceServers.Lock()
+	previousServers := resourceServers.secrets
+	resourceServers.secrets = servers
+	resourceServers.Unlock()
+	t.Cleanup(func() {
+		tokenClients.Lock()
+		tokenClients.clients = previousClients
+		tokenClients.Unlock()
+		resourceServers.Lock()
+		resourceServers.secrets = previousServers
+		resourceServers.Unlock()
+	})
+}
+
+/* Set the memory store and the opaque token format for a test, the previous ones are restored at the end of the test */
+func setTestStore(t *testing.T) *MemoryStore {
+	s := NewMemoryStore()
+	previous, format := store, tokenFormat
+	store, tokenFormat = s, "opaque"
+	t.Cleanup(func() { store, tokenFormat = previous, format })
+	return s
+}
+
+/* Create an expired token, return its plain value */
+func expiredToken(t *testing.T, user, client string) string {
+	then := int64(1000)
+	item := TOKEN{Id: user + "-expired", User: user, Client: client, Token: hashToken("expired-" + user), Created: then, Updated: then}
+	if err := store.Create(item); err != nil {
+		t.Fatal(err)
+	}
+	return "expired-" + user
+}
+
+func testClientSecret(t *testing.T, secret string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestIntrospect(t *testing.T) {
+	setTestStore(t)
+	setTestClients(t, map[string]CLIENT{}, map[string]string{"gateway": "secret"})
+	user, err := generateTokens("alice", "", "10.0.0.1", "family", []string{ScopeTokensRead}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := GenerateClientToken("batch", 3600, []string{ScopeTokensClean}, "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* An active token */
+	code, body := postForm(t, TokensPostIntrospect, "/tokens/introspect", url.Values{"token": {user.Token}}, "gateway", "secret")
+	if code != http.StatusOK || body["active"] != true || body["sub"] != "alice" || body["scope"] != ScopeTokensRead || body["client_id"] != nil {
+		t.Fatalf("Active token: %d %v", code, body)
+	}
+	/* A token of a client, with client_id and client_secret */
+	code, body = postForm(t, TokensPostIntrospect, "/tokens/introspect", url.Values{"token": {client.Token}, "client_id": {"gateway"}, "client_secret": {"secret"}}, "", "")
+	if code != http.StatusOK || body["active"] != true || body["client_id"] != "batch" || body["exp"].(float64) != float64(client.Created+3600) {
+		t.Fatalf("Client token: %d %v", code, body)
+	}
+	/* An expired and an unknown token are inactive */
+	for _, token := range []string{expiredToken(t, "alice", ""), "unknown"} {
+		code, body = postForm(t, TokensPostIntrospect, "/tokens/introspect", url.Values{"token": {token}}, "gateway", "secret")
+		if code != http.StatusOK || body["active"] != false || len(body) != 1 {
+			t.Fatalf("Inactive token %s: %d %v", token, code, body)
+		}
+	}
+	/* A bad resource server secret */
+	if code, body = postForm(t, TokensPostIntrospect, "/tokens/introspect", url.Values{"token": {user.Token}}, "gateway", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("Bad secret: %d %v", code, body)
+	}
+	if code, _ = postForm(t, TokensPostIntrospect, "/tokens/introspect", url.Values{"token": {user.Token}}, "", ""); code != http.StatusUnauthorized {
+		t.Fatalf("No credentials: %d", code)
+	}
+	if code, _ = postForm(t, TokensPostIntrospect, "/tokens/introspect", url.Values{}, "gateway", "secret"); code != http.StatusBadRequest {
+		t.Fatalf("Missing token: %d", code)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	s := setTestStore(t)
+	setTestClients(t, map[string]CLIENT{"batch": {Secret: testClientSecret(t, "secret")}, "app": {Secret: testClientSecret(t, "appsecret")}}, map[string]string{})
+	user, err := generateTokens("alice", "", "10.0.0.1", "family", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := GenerateClientToken("batch", 0, nil, "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := GenerateClientToken("app", 0, nil, "10.0.0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* A bad client secret */
+	if code, body := postForm(t, TokensPostRevoke, "/tokens/revoke", url.Values{"token": {batch.Token}}, "batch", "wrong"); code != http.StatusUnauthorized || body["error"] != "invalid_client" {
+		t.Fatalf("Bad secret: %d %v", code, body)
+	}
+	/* A token of another client, or of a user, is not revoked for a client */
+	for _, token := range []string{app.Token, user.Token} {
+		if code, body := postForm(t, TokensPostRevoke, "/tokens/revoke", url.Values{"token": {token}}, "batch", "secret"); code != http.StatusBadRequest || body["error"] != "unauthorized_client" {
+			t.Fatalf("Token of another client: %d %v", code, body)
+		}
+	}
+	if _, err = s.Get(app.Id); err != nil {
+		t.Fatalf("Token of another client revoked: %v", err)
+	}
+	/* An active token of the client */
+	if code, _ := postForm(t, TokensPostRevoke, "/tokens/revoke", url.Values{"token": {batch.Token}, "client_id": {"batch"}, "client_secret": {"secret"}}, "", ""); code != http.StatusOK {
+		t.Fatalf("Own token: %d", code)
+	}
+	if _, err = s.Get(batch.Id); err != ErrNotFound {
+		t.Fatalf("Own token not revoked: %v", err)
+	}
+	/* A refresh token revokes its family, without client auth */
+	if code, _ := postForm(t, TokensPostRevoke, "/tokens/revoke", url.Values{"token": {user.RefreshToken}}, "", ""); code != http.StatusOK {
+		t.Fatalf("Refresh token: %d", code)
+	}
+	if _, err = s.Get(user.Id); err != ErrNotFound {
+		t.Fatalf("Access token of the family not revoked: %v", err)
+	}
+
+	/* An expired, an unknown, an already revoked and a stateless token succeed (RFC 7009 2.2) */
+	setTestJWTKeys(t, testSigningKey("kid", time.Now().Unix()))
+	tokenFormat = "jwt"
+	jwt, err := GenerateClientToken("batch", 0, nil, "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFormat = "opaque"
+	for _, token := range []string{expiredToken(t, "alice", ""), "unknown", batch.Token, jwt.Token, "v4.local.garbage", "a.b.c"} {
+		if code, body := postForm(t, TokensPostRevoke, "/tokens/revoke", url.Values{"token": {token}}, "", ""); code != http.StatusOK {
+			t.Fatalf("Token %s: %d %v", token, code, body)
+		}
+	}
+	if code, _ := postForm(t, TokensPostRevoke, "/tokens/revoke", url.Values{}, "", ""); code != http.StatusBadRequest {
+		t.Fatalf("Missing token: %d", code)
+	}
+}
+
+/* The dummy secret checked for an unknown client is a valid hash, so it costs as much as a known client */
+func TestUnknownClient(t *testing.T) {
+	setTestClients(t, map[string]CLIENT{"batch": {Secret: testClientSecret(t, "secret")}}, map[string]string{})
+	if cost, err := bcrypt.Cost([]byte(dummyClientSecret)); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("Dummy client secret: %d %v", cost, err)
+	}
+	code, body := postForm(t, TokensPostOAuthToken, "/oauth/token", url.Values{"grant_type": {"client_credentials"}}, "unknown", "secret")
+	if code != http.StatusUnauthorized || body["error"] != "invalid_client" {
+		t.Fatalf("Unknown client: %d %v", code, body)
+	}
+}
@@ -0,0 +1,322 @@
+package tokens
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+)
+
+/* PASETO v4 headers */
+const (
+	pasetoLocalHeader  = "v4.local."
+	pasetoPublicHeader = "v4.public."
+)
+
+/* The claims of a PASETO token, the same fields as the TOKEN struct with registered iat and exp */
+type PasetoClaims struct {
+	Id         string `json:"id"`
+	User       string `json:"user"`
+	Address    string `json:"address"`
+	Created    int64  `json:"created"`
+	Updated    int64  `json:"updated"`
+	Hits       int64  `json:"hits"`
+	Client     string `json:"client,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Scope      string `json:"scope,omitempty"`
+	IssuedAt   string `json:"iat"`
+	Expiration string `json:"exp"`
+}
+
+/* The PASETO keys: a symmetric key for v4.local, an Ed25519 key for v4.public */
+var pasetoKeys struct {
+	sync.RWMutex
+	local   []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+/* Set the PASETO v4.local key, from a file holding 32 bytes in hex */
+func TokensSetPASETOLocalKey(keyFile string) error {
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return err
+	}
+	if len(key) != 32 {
+		return errors.New("PASETO v4.local key must be 32 bytes")
+	}
+	pasetoKeys.Lock()
+	pasetoKeys.local = key
+	pasetoKeys.Unlock()
+	return nil
+}
+
+/* Set the PASETO v4.public key, from a PEM Ed25519 private key file */
+func TokensSetPASETOPublicKey(keyFile string) error {
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	key, err := jwt.ParseEdPrivateKeyFromPEM(content)
+	if err != nil {
+		return err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return errors.New("PASETO v4.public key must be Ed25519")
+	}
+	pasetoKeys.Lock()
+	pasetoKeys.private = private
+	pasetoKeys.public = private.Public().(ed25519.PublicKey)
+	pasetoKeys.Unlock()
+	return nil
+}
+
+/* Test if the key of a PASETO format is set */
+func pasetoKeyReady(format string) bool {
+	pasetoKeys.RLock()
+	defer pasetoKeys.RUnlock()
+	if format == "paseto-local" {
+		return pasetoKeys.local != nil
+	}
+	return pasetoKeys.private != nil
+}
+
+/* Test if a token value is a PASETO v4 token */
+func isPASETO(token string) bool {
+	return strings.HasPrefix(token, pasetoLocalHeader) || strings.HasPrefix(token, pasetoPublicHeader)
+}
+
+/* Pre-authentication encoding */
+func pae(pieces ...[]byte) []byte {
+	var b bytes.Buffer
+	le64 := func(n int) {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(n)&(1<<63-1))
+		b.Write(buf[:])
+	}
+	le64(len(pieces))
+	for _, piece := range pieces {
+		le64(len(piece))
+		b.Write(piece)
+	}
+	return b.Bytes()
+}
+
+/* Keyed BLAKE2b of the given size */
+func blake2bMAC(size int, key []byte, parts ...[]byte) ([]byte, error) {
+	h, err := blake2b.New(size, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil), nil
+}
+
+/* Derive the v4.local encryption key, nonce and authentication key */
+func pasetoLocalKeys(key, n []byte) (ek, n2, ak []byte, err error) {
+	tmp, err := blake2bMAC(56, key, []byte("paseto-encryption-key"), n)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ak, err = blake2bMAC(32, key, []byte("paseto-auth-key-for-aead"), n)
+	return tmp[:32], tmp[32:], ak, err
+}
+
+/* Split a PASETO token into its decoded payload and footer, checking its header */
+func pasetoSplit(header, token string) (payload, footer []byte, err error) {
+	if !strings.HasPrefix(token, header) {
+		return nil, nil, errors.New("Not a " + strings.TrimSuffix(header, ".") + " token")
+	}
+	/* An empty footer is left out, the encoding must be canonical (no trailing bits) */
+	parts := strings.Split(strings.TrimPrefix(token, header), ".")
+	if len(parts) > 2 || (len(parts) == 2 && len(parts[1]) == 0) {
+		return nil, nil, errors.New("Invalid PASETO token")
+	}
+	encoding := base64.RawURLEncoding.Strict()
+	if payload, err = encoding.DecodeString(parts[0]); err != nil {
+		return nil, nil, err
+	}
+	if len(parts) == 2 {
+		if footer, err = encoding.DecodeString(parts[1]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return payload, footer, nil
+}
+
+/* Append the encoded payload and footer (if any) to a PASETO header */
+func pasetoJoin(header string, payload, footer []byte) string {
+	token := header + base64.RawURLEncoding.EncodeToString(payload)
+	if len(footer) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(footer)
+	}
+	return token
+}
+
+/* Encrypt a message as a v4.local token with the 32 bytes nonce n */
+func pasetoEncrypt(key, n, message, footer, implicit []byte) (string, error) {
+	ek, n2, ak, err := pasetoLocalKeys(key, n)
+	if err != nil {
+		return "", err
+	}
+	cipher, err := chacha20.NewUnauthenticatedCipher(ek, n2)
+	if err != nil {
+		return "", err
+	}
+	c := make([]byte, len(message))
+	cipher.XORKeyStream(c, message)
+	t, err := blake2bMAC(32, ak, pae([]byte(pasetoLocalHeader), n, c, footer, implicit))
+	if err != nil {
+		return "", err
+	}
+	payload := append(append(append([]byte{}, n...), c...), t...)
+	return pasetoJoin(pasetoLocalHeader, payload, footer), nil
+}
+
+/* Decrypt a v4.local token, and return its message and footer */
+func pasetoDecrypt(key []byte, token string, implicit []byte) (message, footer []byte, err error) {
+	raw, footer, err := pasetoSplit(pasetoLocalHeader, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(raw) < 64 {
+		return nil, nil, errors.New("PASETO token too short")
+	}
+	n, c, t := raw[:32], raw[32:len(raw)-32], raw[len(raw)-32:]
+	ek, n2, ak, err := pasetoLocalKeys(key, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	t2, err := blake2bMAC(32, ak, pae([]byte(pasetoLocalHeader), n, c, footer, implicit))
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare(t, t2) != 1 {
+		return nil, nil, errors.New("Invalid PASETO token")
+	}
+	cipher, err := chacha20.NewUnauthenticatedCipher(ek, n2)
+	if err != nil {
+		return nil, nil, err
+	}
+	message = make([]byte, len(c))
+	cipher.XORKeyStream(message, c)
+	return message, footer, nil
+}
+
+/* Sign a message as a v4.public token */
+func pasetoSign(key ed25519.PrivateKey, message, footer, implicit []byte) string {
+	sig := ed25519.Sign(key, pae([]byte(pasetoPublicHeader), message, footer, implicit))
+	return pasetoJoin(pasetoPublicHeader, append(append([]byte{}, message...), sig...), footer)
+}
+
+/* Verify a v4.public token, and return its message and footer */
+func pasetoVerify(key ed25519.PublicKey, token string, implicit []byte) (message, footer []byte, err error) {
+	raw, footer, err := pasetoSplit(pasetoPublicHeader, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(raw) < ed25519.SignatureSize {
+		return nil, nil, errors.New("PASETO token too short")
+	}
+	m, sig := raw[:len(raw)-ed25519.SignatureSize], raw[len(raw)-ed25519.SignatureSize:]
+	if !ed25519.Verify(key, pae([]byte(pasetoPublicHeader), m, footer, implicit), sig) {
+		return nil, nil, errors.New("Invalid PASETO token")
+	}
+	return m, footer, nil
+}
+
+/* Encrypt (v4.local) or sign (v4.public) a token item */
+func generatePASETO(item TOKEN, format string) (string, error) {
+	message, err := json.Marshal(PasetoClaims{
+		Id:         item.Id,
+		User:       item.User,
+		Address:    item.Address,
+		Created:    item.Created,
+		Updated:    item.Updated,
+		Hits:       item.Hits,
+		Client:     item.Client,
+		Source:     item.Source,
+		Scope:      formatScopes(item.Scopes),
+		IssuedAt:   time.Unix(item.Created, 0).UTC().Format(time.RFC3339),
+		Expiration: time.Unix(item.ExpiresAt(int64(expireTime)), 0).UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return "", err
+	}
+	pasetoKeys.RLock()
+	defer pasetoKeys.RUnlock()
+	if format == "paseto-local" {
+		if pasetoKeys.local == nil {
+			return "", errors.New("PASETO v4.local key is not set")
+		}
+		n := make([]byte, 32)
+		if _, err = rand.Read(n); err != nil {
+			return "", err
+		}
+		return pasetoEncrypt(pasetoKeys.local, n, message, nil, nil)
+	}
+	if pasetoKeys.private == nil {
+		return "", errors.New("PASETO v4.public key is not set")
+	}
+	return pasetoSign(pasetoKeys.private, message, nil, nil), nil
+}
+
+/* Decrypt or verify a PASETO v4 token, check its expiry and return its claims */
+func validatePASETO(token string) (*PasetoClaims, error) {
+	var message, footer []byte
+	var err error
+	pasetoKeys.RLock()
+	local, public := pasetoKeys.local, pasetoKeys.public
+	pasetoKeys.RUnlock()
+	if strings.HasPrefix(token, pasetoLocalHeader) {
+		if local == nil {
+			return nil, errors.New("PASETO v4.local key is not set")
+		}
+		message, footer, err = pasetoDecrypt(local, token, nil)
+	} else if strings.HasPrefix(token, pasetoPublicHeader) {
+		if public == nil {
+			return nil, errors.New("PASETO v4.public key is not set")
+		}
+		message, footer, err = pasetoVerify(public, token, nil)
+	} else {
+		return nil, errors.New("Not a PASETO v4 token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(footer) > 0 {
+		return nil, errors.New("PASETO footer is not supported")
+	}
+	claims := &PasetoClaims{}
+	if err = json.Unmarshal(message, claims); err != nil {
+		return nil, err
+	}
+	exp, err := time.Parse(time.RFC3339, claims.Expiration)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(exp) {
+		return nil, errors.New("PASETO token is expired")
+	}
+	return claims, nil
+}
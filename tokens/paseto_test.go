@@ -0,0 +1,184 @@
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* The official PASETO v4 test vectors (https://github.com/paseto-standard/test-vectors) */
+type pasetoVector struct {
+	Name       string `json:"name"`
+	ExpectFail bool   `json:"expect-fail"`
+	Key        string `json:"key"`
+	Nonce      string `json:"nonce"`
+	PublicKey  string `json:"public-key"`
+	SecretSeed string `json:"secret-key-seed"`
+	Token      string `json:"token"`
+	Payload    string `json:"payload"`
+	Footer     string `json:"footer"`
+	Implicit   string `json:"implicit-assertion"`
+}
+
+func readPasetoVectors(t *testing.T) []pasetoVector {
+	content, err := os.ReadFile("testdata/paseto-v4.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors struct {
+		Tests []pasetoVector `json:"tests"`
+	}
+	if err = json.Unmarshal(content, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	return vectors.Tests
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPasetoVectors(t *testing.T) {
+	vectors := readPasetoVectors(t)
+	if len(vectors) == 0 {
+		t.Fatal("No test vector")
+	}
+	for _, v := range vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			var message, footer []byte
+			var err error
+			if len(v.Key) > 0 {
+				key := decodeHex(t, v.Key)
+				if !v.ExpectFail {
+					token, err := pasetoEncrypt(key, decodeHex(t, v.Nonce), []byte(v.Payload), []byte(v.Footer), []byte(v.Implicit))
+					if err != nil || token != v.Token {
+						t.Fatalf("Encrypt: %s %v", token, err)
+					}
+				}
+				message, footer, err = pasetoDecrypt(key, v.Token, []byte(v.Implicit))
+			} else {
+				if !v.ExpectFail {
+					private := ed25519.NewKeyFromSeed(decodeHex(t, v.SecretSeed))
+					if token := pasetoSign(private, []byte(v.Payload), []byte(v.Footer), []byte(v.Implicit)); token != v.Token {
+						t.Fatalf("Sign: %s", token)
+					}
+				}
+				message, footer, err = pasetoVerify(ed25519.PublicKey(decodeHex(t, v.PublicKey)), v.Token, []byte(v.Implicit))
+			}
+			if v.ExpectFail {
+				if err == nil {
+					t.Fatalf("Token accepted: %s", message)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(message) != v.Payload || string(footer) != v.Footer {
+				t.Fatalf("Message %s, footer %s", message, footer)
+			}
+			/* A wrong implicit assertion is rejected */
+			if len(v.Key) > 0 {
+				_, _, err = pasetoDecrypt(decodeHex(t, v.Key), v.Token, []byte("wrong"))
+			} else {
+				_, _, err = pasetoVerify(ed25519.PublicKey(decodeHex(t, v.PublicKey)), v.Token, []byte("wrong"))
+			}
+			if err == nil {
+				t.Fatal("Token accepted with a wrong implicit assertion")
+			}
+		})
+	}
+}
+
+/* Set test PASETO keys, the previous keys are restored at the end of the test */
+func setTestPasetoKeys(t *testing.T) {
+	pasetoKeys.Lock()
+	local, private, public := pasetoKeys.local, pasetoKeys.private, pasetoKeys.public
+	pasetoKeys.local = decodeHex(t, "707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f")
+	pasetoKeys.private = ed25519.NewKeyFromSeed(decodeHex(t, "b4cbfb43df4ce210727d953e4a713307fa19bb7d9f85041438d9e11b942a3774"))
+	pasetoKeys.public = pasetoKeys.private.Public().(ed25519.PublicKey)
+	pasetoKeys.Unlock()
+	t.Cleanup(func() {
+		pasetoKeys.Lock()
+		pasetoKeys.local, pasetoKeys.private, pasetoKeys.public = local, private, public
+		pasetoKeys.Unlock()
+	})
+}
+
+/* Change one character in the middle of a token */
+func tamper(token string) string {
+	i := len(token) / 2
+	c := byte('A')
+	if token[i] == 'A' {
+		c = 'B'
+	}
+	return token[:i] + string(c) + token[i+1:]
+}
+
+func TestPasetoRoundTrip(t *testing.T) {
+	setTestPasetoKeys(t)
+	now := time.Now().Unix()
+	item := TOKEN{Id: "id1", User: "alice", Address: "10.0.0.1", Created: now, Updated: now, Client: "app", Source: "ldap", Scopes: []string{"tokens:read", "tokens:write"}}
+	for _, format := range []string{"paseto-local", "paseto-public"} {
+		token, err := generatePASETO(item, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isPASETO(token) {
+			t.Fatalf("%s: not a PASETO token %s", format, token)
+		}
+		claims, err := validatePASETO(token)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if claims.Id != item.Id || claims.User != item.User || claims.Client != item.Client || claims.Source != item.Source || claims.Scope != "tokens:read tokens:write" {
+			t.Fatalf("%s: claims %+v", format, claims)
+		}
+		if _, err = validatePASETO(tamper(token)); err == nil {
+			t.Fatalf("%s: tampered token accepted", format)
+		}
+		if _, err = validatePASETO(token + "."); err == nil {
+			t.Fatalf("%s: token with an empty footer accepted", format)
+		}
+	}
+
+	/* A v4.public token is not valid as a v4.local one */
+	token, _ := generatePASETO(item, "paseto-public")
+	if _, err := validatePASETO(pasetoLocalHeader + strings.TrimPrefix(token, pasetoPublicHeader)); err == nil {
+		t.Fatal("v4.public token accepted as v4.local")
+	}
+	/* The server does not issue footers */
+	token, _ = pasetoEncrypt(pasetoKeys.local, make([]byte, 32), []byte(`{"exp":"2100-01-01T00:00:00Z"}`), []byte("footer"), nil)
+	if _, err := validatePASETO(token); err == nil {
+		t.Fatal("Token with a footer accepted")
+	}
+}
+
+func TestPasetoExpired(t *testing.T) {
+	setTestPasetoKeys(t)
+	then := time.Now().Unix() - int64(expireTime) - 10
+	item := TOKEN{Id: "id1", User: "alice", Created: then, Updated: then}
+	for _, format := range []string{"paseto-local", "paseto-public"} {
+		token, err := generatePASETO(item, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = validatePASETO(token); err == nil {
+			t.Fatalf("%s: expired token accepted", format)
+		}
+	}
+	/* The lifetime of a client token wins over the expiration time */
+	item.Lifetime = int64(expireTime) + 3600
+	token, _ := generatePASETO(item, "paseto-local")
+	if _, err := validatePASETO(token); err != nil {
+		t.Fatal(err)
+	}
+}
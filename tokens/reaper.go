@@ -0,0 +1,36 @@
+package tokens
+
+import (
+	"log"
+	"time"
+)
+
+/* Start the background reaper, purging expired tokens and challenge data every interval
+ * The returned function stops the reaper and waits for its end
+ * A null interval disables the reaper, expired tokens are then only purged by POST /tokens/clean
+ */
+func TokensStartReaper(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				TokensClean()
+			case <-quit:
+				return
+			}
+		}
+	}()
+	log.Println("Starting reaper every " + interval.String())
+	return func() {
+		close(quit)
+		<-done
+	}
+}
@@ -0,0 +1,55 @@
+package tokens
+
+import (
+	"testing"
+	"time"
+)
+
+/* The reaper removes the expired tokens and challenge data, and stops */
+func TestReaper(t *testing.T) {
+	s := NewMemoryStore()
+	previous := store
+	TokensSetStore(s)
+	defer TokensSetStore(previous)
+
+	then := time.Now().Unix() - int64(expireTime) - 10
+	if err := s.Create(TOKEN{Id: "id1", Token: "value1", Created: then, Updated: then}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(TOKEN{Id: "id2", Token: "value2", Created: then + 20, Updated: then + 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateChallenge(CHALLENGEDATA{Id: "c1", Data: "data", Created: then, Address: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := TokensStartReaper(10 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, errToken := s.Get("id1")
+		_, errChallenge := s.GetChallenge("c1")
+		if errToken == ErrNotFound && errChallenge == ErrNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expired token or challenge data kept: %v %v", errToken, errChallenge)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reaper not stopped")
+	}
+	if _, err := s.Get("id2"); err != nil {
+		t.Fatalf("Valid token removed: %v", err)
+	}
+
+	/* A null interval disables the reaper */
+	TokensStartReaper(0)()
+}
@@ -0,0 +1,122 @@
+package tokens
+
+import (
+	"log"
+	"net/http"
+
+	"gotokens/tools"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Refresh token lifetime (in seconds), refresh tokens are disabled if null */
+var refreshTime int64 = 86400
+
+func TokensSetRefreshTime(ex int) {
+	refreshTime = int64(ex)
+}
+
+/* Generate an access token, and a refresh token if enabled and refresh is set, in the given family with the given scopes
+ * source is the authenticator of an external user (see authenticatorSource), empty for the users list
+ * The users authenticated by another authenticator than the users list get no refresh token:
+ * the server can not check later that they still exist in their source, nor that they are not locked
+ */
+func generateTokens(user string, source string, RemoteAddr string, family string, scopes []string, refresh bool) (TOKEN, error) {
+	item := newToken(user, RemoteAddr)
+	item.Source = source
+	item.Family = family
+	item.Scopes = scopes
+	item, err := createToken(item)
+	if err != nil || refreshTime <= 0 || !refresh {
+		return item, err
+	}
+	next := newToken(user, RemoteAddr)
+	next.Source = source
+	next.Family = family
+	next.Refresh = true
+	next.Lifetime = refreshTime
+	next.Scopes = scopes
+	token, err := tools.SecureRandom(tokenLength, tokenEncoding)
+	if err != nil {
+		return TOKEN{}, err
+	}
+	next.Token = hashToken(token)
+	if err = store.Create(next); err != nil {
+		return TOKEN{}, err
+	}
+	log.Println("Create refresh token " + next.Id + " for user " + next.User)
+	item.RefreshToken = token
+	return item, nil
+}
+
+/* Revoke all the tokens of a family, access and refresh tokens
+ * Stateless access tokens (JWT, PASETO) can not be revoked, they stay valid until they expire
+ */
+func revokeFamily(family string) error {
+	if len(family) == 0 {
+		return nil
+	}
+	removed, err := store.DeleteFamily(family)
+	for _, item := range removed {
+		log.Println("Revoke token " + item.Id + " for user " + item.User)
+	}
+	return err
+}
+
+/* The refresh token input */
+type INPUTREFRESH struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+/* Exchange a refresh token for a new access and refresh tokens pair (POST /tokens/refresh)
+ * with refresh token in request body {"refresh_token":"xxx"}
+ * A refresh token is used once, a reused refresh token revokes its whole family
+ * The new tokens keep the scopes of the refresh token still allowed by the current roles of the user
+ * 400 -> Wrong parameter
+ * 401 -> Invalid, expired or reused refresh token
+ * 201 -> Tokens created (cookie post)
+ */
+func TokensPostRefresh(c *gin.Context) {
+	var input INPUTREFRESH
+	if err := c.BindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	now := tools.Epoch()
+	item, err := store.GetByValue(hashToken(input.RefreshToken))
+	if err == nil && !item.Refresh {
+		err = ErrNotFound
+	}
+	if user, found := getTokenUser(item.User); err == nil && (!found || user.Disabled) {
+		log.Println("Refresh token " + item.Id + " of removed, disabled or external user " + item.User)
+		err = ErrNotFound
+	}
+	if err == nil && tokenExpired(item, now) {
+		log.Println("Remove token " + item.Token)
+		store.Delete(item.Id)
+		err = ErrNotFound
+	}
+	if err == nil {
+		item, err = store.Redeem(item.Id, now)
+	}
+	if err == ErrTokenUsed {
+		log.Println("Refresh token " + item.Id + " reused, revoke family " + item.Family + " of user " + item.User)
+		if err = revokeFamily(item.Family); err != nil {
+			log.Println("Can not revoke family: " + err.Error())
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Refresh token reused"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized"})
+		return
+	}
+	scopes := grantScopes(item.Scopes, allowedScopes(item.User, userRoles(item.User)))
+	item, err = generateTokens(item.User, item.Source, clientAddress(c), item.Family, scopes, true)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	c.SetCookie("Token", tools.StringEncode(item.User, TokenCode)+"-"+item.Token, tokenTTL, "/", tools.Replace(":[0-9]*$", "", c.Request.Host), false, true)
+	c.JSON(http.StatusCreated, item)
+}
@@ -0,0 +1,209 @@
+package tokens
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"gotokens/tools"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/* Revoke the tokens of the users removed or disabled, on reload or through the users API */
+var usersRevoke bool
+
+func TokensSetUsersRevoke(revoke bool) {
+	usersRevoke = revoke
+}
+
+/* Read and validate a users file (JSON, YAML, TOML or INI): every user needs a login, a password and known roles
+ * The roles can be given as a comma-separated list (INI)
+ */
+func readUsers(file string) (map[string]USER, error) {
+	/* An empty file is refused, it is most likely being written: the current users list is kept */
+	if info, err := os.Stat(file); err != nil {
+		return nil, err
+	} else if info.Size() == 0 {
+		return nil, errors.New("Empty users file")
+	}
+	users := make(map[string]USER)
+	if err := tools.ReadFromAllFile(file, &users); err != nil {
+		return nil, err
+	}
+	for login, user := range users {
+		if len(login) == 0 {
+			return nil, errors.New("Empty login")
+		}
+		if len(user.Password) == 0 {
+			return nil, errors.New("Empty password for user " + login)
+		}
+		roles := []string{}
+		for _, role := range user.Roles {
+			for _, r := range strings.Split(role, ",") {
+				if r = strings.TrimSpace(r); !validRole(r) {
+					return nil, errors.New("Unknown role " + r + " for user " + login)
+				}
+				roles = append(roles, r)
+			}
+		}
+		if len(roles) > 0 {
+			user.Roles = roles
+		} else {
+			user.Roles = nil
+		}
+		users[login] = user
+	}
+	return users, nil
+}
+
+/* Convert a users file to another format, given by the extension of the output file (.json, .yaml, .yml, .toml, .ini) */
+func TokensConvertUsers(input, output string) error {
+	users, err := readUsers(input)
+	if err != nil {
+		return err
+	}
+	return tools.WriteToAllFile(output, users)
+}
+
+/* Load the users list from file (JSON, YAML, TOML or INI)
+ * The changes made through the users API are written back to this file, in the same format
+ * A missing file is an empty users list
+ */
+func TokensLoadUsers(file string) error {
+	usersFile = file
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		log.Println("No users file " + file)
+		return nil
+	}
+	return TokensReloadUsers()
+}
+
+/* Reload the users file, the users list is replaced at once
+ * The current users list is kept if the file can not be read or is not valid
+ * The users added from the command line are kept, the store is then synchronized with the users list as on startup
+ */
+func TokensReloadUsers() error {
+	users, err := readUsers(usersFile)
+	if err != nil {
+		log.Println("Users file " + usersFile + " not reloaded: " + err.Error())
+		return err
+	}
+	file := make(map[string]USER, len(users))
+	for login, user := range users {
+		file[login] = user
+	}
+	tokenUsers.Lock()
+	old := tokenUsers.users
+	for login := range tokenUsers.added {
+		users[login] = old[login]
+	}
+	tokenUsers.users = users
+	tokenUsers.file = file
+	tokenUsers.Unlock()
+
+	revoked := []string{}
+	for login, user := range users {
+		if previous, found := old[login]; !found || !reflect.DeepEqual(previous, user) {
+			checkUser(login, user)
+			if found && user.Disabled && !previous.Disabled {
+				revoked = append(revoked, login)
+			}
+		}
+	}
+	for login, user := range old {
+		if _, found := users[login]; !found {
+			log.Println("Remove user " + login)
+			if !user.Disabled {
+				revoked = append(revoked, login)
+			}
+		}
+	}
+	log.Println("Users file " + usersFile + " reloaded")
+
+	if err = TokensSyncUsers(); err != nil {
+		return err
+	}
+	if usersRevoke {
+		for _, login := range revoked {
+			if err = revokeUser(login); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/* Revoke all the tokens of a user
+ * Stateless access tokens (JWT, PASETO) can not be revoked, they stay valid until they expire
+ */
+func revokeUser(login string) error {
+	removed, err := store.DeleteUserTokens(login)
+	for _, item := range removed {
+		log.Println("Revoke token " + item.Id + " for user " + item.User)
+	}
+	return err
+}
+
+/* Watch the users file and reload it on change
+ * The returned function stops the watcher and waits for its end
+ */
+func TokensWatchUsers() (stop func(), err error) {
+	return watchFile(usersFile, TokensReloadUsers)
+}
+
+/* Watch a file and call reload on change
+ * The directory is watched, to follow a file replaced by an atomic write (rename)
+ * The returned function stops the watcher and waits for its end
+ */
+func watchFile(file string, reload func() error) (stop func(), err error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	name := filepath.Clean(file)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		/* An editor often writes a file several times in a row, the reload waits for the last write */
+		var timer *time.Timer
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != name || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(100*time.Millisecond, func() { reload() })
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("Watcher of " + file + ": " + err.Error())
+			}
+		}
+	}()
+	log.Println("Watching file " + file)
+	return func() {
+		watcher.Close()
+		<-done
+	}, nil
+}
@@ -0,0 +1,55 @@
+package tokens
+
+/* The user roles */
+const (
+	RoleAdmin    = "admin"    /* manages all the tokens and the keys */
+	RoleOperator = "operator" /* manages its own tokens, and cleans expired tokens */
+	RoleUser     = "user"     /* manages its own tokens, the default role */
+	RoleService  = "service"  /* reads its own tokens */
+)
+
+/* The permissions (scopes) granted by each role */
+var rolePermissions = map[string][]string{
+	RoleAdmin:    AllScopes,
+	RoleOperator: {ScopeTokensRead, ScopeTokensDelete, ScopeTokensClean},
+	RoleUser:     {ScopeTokensRead, ScopeTokensDelete},
+	RoleService:  {ScopeTokensRead},
+}
+
+/* Test if a role is known */
+func validRole(role string) bool {
+	_, found := rolePermissions[role]
+	return found
+}
+
+/* Get the roles of a user of the users list, the user role if none is set */
+func userRoles(login string) []string {
+	user, found := getTokenUser(login)
+	if !found || len(user.Roles) == 0 {
+		return []string{RoleUser}
+	}
+	return user.Roles
+}
+
+/* Get the permissions of a list of roles, those of the user role if empty */
+func rolesScopes(roles []string) []string {
+	if len(roles) == 0 {
+		roles = []string{RoleUser}
+	}
+	var scopes []string
+	for _, role := range roles {
+		for _, scope := range rolePermissions[role] {
+			if !hasScope(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+/* Test if a token can access a token of another user (scope tokens:all), or the token is its own
+ * a client and a user, or users of different sources (see authenticatorSource), with the same name do not own each other's tokens
+ */
+func canAccessToken(caller, item TOKEN) bool {
+	return hasScope(caller.Scopes, ScopeTokensAll) || (caller.User == item.User && caller.Client == item.Client && caller.Source == item.Source)
+}
@@ -0,0 +1,118 @@
+package tokens
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"gotokens/tools"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* The scopes required by the admin routes */
+const (
+	ScopeTokensRead   = "tokens:read"   /* GET /tokens, GET /tokens/:id */
+	ScopeTokensDelete = "tokens:delete" /* DELETE /tokens/:id */
+	ScopeTokensAll    = "tokens:all"    /* read and delete the tokens of all the users, not only its own */
+	ScopeTokensClean  = "tokens:clean"  /* POST /tokens/clean */
+	ScopeKeysRotate   = "keys:rotate"   /* POST /tokens/keys/rotate */
+	ScopeUsersManage  = "users:manage"  /* /tokens/users */
+)
+
+/* All the known scopes */
+var AllScopes = []string{ScopeTokensRead, ScopeTokensDelete, ScopeTokensAll, ScopeTokensClean, ScopeKeysRotate, ScopeUsersManage}
+
+/* The scopes each user is allowed to get besides the permissions of its roles : map[login] => scopes */
+var userScopes = struct {
+	sync.RWMutex
+	scopes map[string][]string
+}{scopes: make(map[string][]string)}
+
+/* Load the allowed scopes of the users from a JSON file {"login":["tokens:read",...],...} */
+func TokensLoadUserScopes(file string) error {
+	scopes := make(map[string][]string)
+	if err := tools.ReadFromJSONFile(file, &scopes); err != nil {
+		return err
+	}
+	userScopes.Lock()
+	for login, list := range scopes {
+		userScopes.scopes[login] = list
+	}
+	userScopes.Unlock()
+	return nil
+}
+
+/* Set the allowed scopes of a user */
+func TokensSetUserScopes(login string, scopes []string) {
+	userScopes.Lock()
+	userScopes.scopes[login] = scopes
+	userScopes.Unlock()
+}
+
+/* Get the allowed scopes of a user, from its roles (given by its authenticator) and its own scopes */
+func allowedScopes(login string, roles []string) []string {
+	scopes := rolesScopes(roles)
+	userScopes.RLock()
+	defer userScopes.RUnlock()
+	for _, scope := range userScopes.scopes[login] {
+		if !hasScope(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+/* Parse a space-separated scope list (OAuth2 scope parameter) */
+func parseScopes(scope string) []string {
+	return strings.Fields(scope)
+}
+
+/* Format a scope list as a space-separated string */
+func formatScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+/* Grant the requested scopes within the allowed ones
+ * Without requested scopes, all the allowed scopes are granted
+ */
+func grantScopes(requested, allowed []string) []string {
+	if len(requested) == 0 {
+		requested = allowed
+	}
+	granted := []string{}
+	for _, scope := range requested {
+		if hasScope(allowed, scope) && !hasScope(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	sort.Strings(granted)
+	return granted
+}
+
+/* Test if a scope is in a scope list */
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+/* Test the token of the request (see TestToken) and its scope
+ * Abort with 401 if the token is not valid, with 403 if the token does not hold the scope
+ */
+func testTokenScope(c *gin.Context, scope string) (TOKEN, bool) {
+	item, ok := authToken(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized"})
+		return item, false
+	}
+	if !hasScope(item.Scopes, scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "failed", "message": "Forbidden, missing scope " + scope})
+		return item, false
+	}
+	return item, true
+}
@@ -0,0 +1,211 @@
+package tokens
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gotokens/tools"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* The PBKDF2 iterations of the SCRAM keys derived from plaintext passwords */
+const scramIterations = 4096
+
+/* The SCRAM message input and output
+ * - start: client-first-message in, server-first-message out
+ * - finish: client-final-message in, server-final-message out
+ */
+type INPUTSCRAM struct {
+	Id    string `json:"id"` /* the challenge data id, from the ChallengeData cookie if empty */
+	Scram string `json:"scram" binding:"required"`
+	Scope string `json:"scope"` /* requested scopes, space-separated */
+}
+
+/* The SCRAM response of a successful exchange: the token and the server-final-message */
+type SCRAMFINAL struct {
+	TOKEN
+	Scram string `json:"scram"`
+}
+
+/* Get the SCRAM keys of a user: salt, iterations, stored key, server key
+ * They are read from a SCRAM-SHA-256 verifier, or derived from a plaintext password with a salt derived from the server secret
+ * Other hashes (bcrypt, argon2id, scrypt) can not be used, the user is then handled as an unknown user, as a disabled user
+ */
+func scramKeys(login string) ([]byte, int, []byte, []byte, bool) {
+	salt, _ := hex.DecodeString(tools.HMACSHA256(tokenSecret, "scram:"+login))
+	salt = salt[:16]
+	user, found := getTokenUser(login)
+	if found && user.Disabled {
+		log.Println("Disabled user " + login)
+		found = false
+	}
+	if found && strings.HasPrefix(user.Password, "SCRAM-SHA-256$") {
+		s, iterations, storedKey, serverKey, err := tools.ParseSCRAMSHA256(user.Password)
+		if err == nil {
+			return s, iterations, storedKey, serverKey, true
+		}
+		log.Println("Wrong SCRAM-SHA-256 hash for user " + login + ": " + err.Error())
+	} else if found && !tools.IsPasswordHash(user.Password) {
+		_, storedKey, serverKey := tools.SCRAMSHA256Keys(user.Password, salt, scramIterations)
+		return salt, scramIterations, storedKey, serverKey, true
+	} else if found {
+		log.Println("SCRAM needs a SCRAM-SHA-256 or plaintext password for user " + login)
+	}
+	return salt, scramIterations, nil, nil, false
+}
+
+/* Make the SCRAM-SHA-256 verifier of a password, to be written in the users file (tokens users scram)
+ * It is accepted by every authentication method, SCRAM included
+ */
+func TokensSCRAMVerifier(password string) (string, error) {
+	if len(password) == 0 {
+		return "", errors.New("Empty password")
+	}
+	return tools.SCRAMSHA256HashPassword(password, scramIterations)
+}
+
+/* Parse the attributes of a SCRAM message (a=value,b=value) */
+func scramAttributes(message string) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range strings.Split(message, ",") {
+		if len(attribute) > 2 && attribute[1] == '=' {
+			attributes[attribute[:1]] = attribute[2:]
+		}
+	}
+	return attributes
+}
+
+/* Decode a SCRAM user name (=2C for comma, =3D for equal) */
+func scramUser(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
+
+/* Start a SCRAM-SHA-256 exchange (POST /tokens/scram/start)
+ * with client-first-message in request body {"scram":"n,,n=login,r=clientnonce"}
+ * The exchange is kept as a challenge data bound to the client address, its id is returned in the ChallengeData cookie
+ * no auth
+ * 400 -> Wrong parameter
+ * 429 -> Too many outstanding challenge data for the client
+ * 200 -> Ok, {"id":"...","scram":"r=nonce,s=salt,i=4096"}
+ */
+func TokensPostSCRAMStart(c *gin.Context) {
+	var input INPUTSCRAM
+	if err := c.BindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	/* GS2 header: no channel binding, no authorization identity */
+	if !strings.HasPrefix(input.Scram, "n,,") && !strings.HasPrefix(input.Scram, "y,,") {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": "Unsupported SCRAM channel binding"})
+		return
+	}
+	attributes := scramAttributes(input.Scram[3:])
+	if len(attributes["n"]) == 0 || len(attributes["r"]) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": "Wrong SCRAM client-first-message"})
+		return
+	}
+	nonce, err := tools.SecureRandom(24, "base64url")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	salt, iterations, _, _, _ := scramKeys(scramUser(attributes["n"]))
+	serverFirst := "r=" + attributes["r"] + nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=" + strconv.Itoa(iterations)
+	item, err := createChallenge(input.Scram+"\n"+serverFirst, clientAddress(c))
+	if err == ErrChallengeLimit {
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"status": "failed", "message": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	c.SetCookie("ChallengeData", item.Id, tokenTTL, "/", tools.Replace(":[0-9]*$", "", c.Request.Host), false, true)
+	c.JSON(http.StatusOK, gin.H{"id": item.Id, "scram": serverFirst})
+}
+
+/* Finish a SCRAM-SHA-256 exchange and create a new token (POST /tokens/scram/finish)
+ * with client-final-message in request body {"id":"...","scram":"c=biws,r=nonce,p=proof"}
+ * and optional requested scopes {"scope":"tokens:read"}, all the allowed scopes by default
+ * The exchange can only be finished once, from the client address that started it
+ * no auth
+ * 400 -> Wrong parameter
+ * 401 -> Wrong proof, unknown exchange, or exchange started by another client
+ * 409 -> Exchange already finished (replay)
+ * 201 -> Token created (cookie post), with the server-final-message {"scram":"v=signature",...}
+ */
+func TokensPostSCRAMFinish(c *gin.Context) {
+	var input INPUTSCRAM
+	if err := c.BindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	if len(input.Id) == 0 {
+		input.Id, _ = c.Cookie("ChallengeData")
+	}
+	challenge, err := useChallenge(input.Id, clientAddress(c))
+	if err == ErrChallengeReplayed {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"status": "failed", "message": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized"})
+		return
+	}
+	messages := strings.SplitN(challenge.Data, "\n", 2)
+	if len(messages) != 2 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized"})
+		return
+	}
+	clientFirst, serverFirst := messages[0], messages[1]
+	clientFirstBare := clientFirst[3:]
+	login := scramUser(scramAttributes(clientFirstBare)["n"])
+	i := strings.LastIndex(input.Scram, ",p=")
+	if i < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": "Wrong SCRAM client-final-message"})
+		return
+	}
+	attributes := scramAttributes(input.Scram)
+	proof, err := base64.StdEncoding.DecodeString(attributes["p"])
+	if err != nil || attributes["c"] != base64.StdEncoding.EncodeToString([]byte(clientFirst[:3])) ||
+		attributes["r"] != scramAttributes(serverFirst)["r"] || len(proof) != sha256.Size {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": "Wrong SCRAM client-final-message"})
+		return
+	}
+	_, _, storedKey, serverKey, ok := scramKeys(login)
+	authMessage := clientFirstBare + "," + serverFirst + "," + input.Scram[:i]
+	if ok {
+		/* ClientKey = ClientProof XOR HMAC(StoredKey, AuthMessage), then H(ClientKey) must be StoredKey */
+		mac := hmac.New(sha256.New, storedKey)
+		mac.Write([]byte(authMessage))
+		clientKey := mac.Sum(nil)
+		for j := range clientKey {
+			clientKey[j] ^= proof[j]
+		}
+		computed := sha256.Sum256(clientKey)
+		ok = subtle.ConstantTimeCompare(computed[:], storedKey) == 1
+	}
+	if !ok {
+		log.Println("SCRAM authentication failed for user " + login)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized"})
+		return
+	}
+	scopes := grantScopes(parseScopes(input.Scope), allowedScopes(login, userRoles(login)))
+	item, err := generateTokens(login, "", clientAddress(c), tools.Genuuid(), scopes, true)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	mac := hmac.New(sha256.New, serverKey)
+	mac.Write([]byte(authMessage))
+	c.SetCookie("ChallengeData", "", -1, "/", tools.Replace(":[0-9]*$", "", c.Request.Host), false, true)
+	c.SetCookie("Token", tools.StringEncode(item.User, TokenCode)+"-"+item.Token, tokenTTL, "/", tools.Replace(":[0-9]*$", "", c.Request.Host), false, true)
+	c.JSON(http.StatusCreated, SCRAMFINAL{TOKEN: item, Scram: "v=" + base64.StdEncoding.EncodeToString(mac.Sum(nil))})
+}
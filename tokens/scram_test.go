@@ -0,0 +1,158 @@
+package tokens
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotokens/tools"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* The SCRAM-SHA-256 exchange of RFC 7677, user "user" and password "pencil" */
+const (
+	rfcClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfcServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfcClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfcServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+/* Post a SCRAM message to a handler from a client address */
+func postSCRAM(t *testing.T, handler gin.HandlerFunc, address string, input INPUTSCRAM) (int, map[string]interface{}) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	body, _ := json.Marshal(input)
+	c.Request = httptest.NewRequest(http.MethodPost, "/tokens/scram", bytes.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Request.RemoteAddr = address
+	handler(c)
+	output := make(map[string]interface{})
+	if err := json.Unmarshal(w.Body.Bytes(), &output); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, output
+}
+
+/* Set the RFC 7677 user, with the verifier of "pencil" and the salt of the RFC */
+func setSCRAMTestUser(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	_, storedKey, serverKey := tools.SCRAMSHA256Keys("pencil", salt, 4096)
+	verifier := "SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$" + base64.StdEncoding.EncodeToString(storedKey) + ":" + base64.StdEncoding.EncodeToString(serverKey)
+	setTestUsers(t, "", map[string]USER{"user": {Password: verifier}})
+}
+
+/* Start the RFC 7677 exchange from an address, with the server nonce of the RFC */
+func startRFCExchange(t *testing.T, address string) string {
+	item, err := createChallenge(rfcClientFirst+"\n"+rfcServerFirst, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item.Id
+}
+
+func TestSCRAMStart(t *testing.T) {
+	setTestStore(t)
+	setSCRAMTestUser(t)
+	code, output := postSCRAM(t, TokensPostSCRAMStart, "192.0.2.1:1234", INPUTSCRAM{Scram: rfcClientFirst})
+	if code != http.StatusOK {
+		t.Fatalf("Start: %d %v", code, output)
+	}
+	serverFirst, _ := output["scram"].(string)
+	if !strings.HasPrefix(serverFirst, "r=rOprNGfwEbeRWgbNEkqO") || !strings.HasSuffix(serverFirst, ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096") {
+		t.Fatalf("Server-first-message %q", serverFirst)
+	}
+	/* Channel binding is not supported */
+	for _, message := range []string{"p=tls-server-end-point,,n=user,r=rOprNGfwEbeRWgbNEkqO", "n,a=admin,n=user,r=rOprNGfwEbeRWgbNEkqO", "n,,r=rOprNGfwEbeRWgbNEkqO"} {
+		if code, output = postSCRAM(t, TokensPostSCRAMStart, "192.0.2.1:1234", INPUTSCRAM{Scram: message}); code != http.StatusBadRequest {
+			t.Fatalf("Client-first-message %q: %d %v", message, code, output)
+		}
+	}
+}
+
+func TestSCRAMFinish(t *testing.T) {
+	setTestStore(t)
+	setTestSecret(t)
+	setSCRAMTestUser(t)
+
+	/* The RFC 7677 exchange, then its replay */
+	id := startRFCExchange(t, "192.0.2.1")
+	code, output := postSCRAM(t, TokensPostSCRAMFinish, "192.0.2.1:1234", INPUTSCRAM{Id: id, Scram: rfcClientFinal})
+	if code != http.StatusCreated || output["scram"] != rfcServerFinal || output["user"] != "user" {
+		t.Fatalf("Finish: %d %v", code, output)
+	}
+	if code, output = postSCRAM(t, TokensPostSCRAMFinish, "192.0.2.1:1234", INPUTSCRAM{Id: id, Scram: rfcClientFinal}); code != http.StatusConflict {
+		t.Fatalf("Replay: %d %v", code, output)
+	}
+
+	/* A wrong proof */
+	wrong := strings.Replace(rfcClientFinal, "p=dHzb", "p=eHzb", 1)
+	if code, output = postSCRAM(t, TokensPostSCRAMFinish, "192.0.2.1:1234", INPUTSCRAM{Id: startRFCExchange(t, "192.0.2.1"), Scram: wrong}); code != http.StatusUnauthorized {
+		t.Fatalf("Wrong proof: %d %v", code, output)
+	}
+	/* An exchange finished from another address */
+	if code, output = postSCRAM(t, TokensPostSCRAMFinish, "192.0.2.2:1234", INPUTSCRAM{Id: startRFCExchange(t, "192.0.2.1"), Scram: rfcClientFinal}); code != http.StatusUnauthorized {
+		t.Fatalf("Another address: %d %v", code, output)
+	}
+	/* A wrong channel binding or nonce */
+	for _, message := range []string{
+		strings.Replace(rfcClientFinal, "c=biws", "c=eSws", 1),
+		strings.Replace(rfcClientFinal, "hNlF$k0", "hNlF$k1", 1),
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+	} {
+		if code, output = postSCRAM(t, TokensPostSCRAMFinish, "192.0.2.1:1234", INPUTSCRAM{Id: startRFCExchange(t, "192.0.2.1"), Scram: message}); code != http.StatusBadRequest {
+			t.Fatalf("Client-final-message %q: %d %v", message, code, output)
+		}
+	}
+	/* A user with a bcrypt hash can not use SCRAM */
+	hash, err := tools.BCRYPTHashPassword("pencil", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestUsers(t, "", map[string]USER{"user": {Password: hash}})
+	if code, output = postSCRAM(t, TokensPostSCRAMFinish, "192.0.2.1:1234", INPUTSCRAM{Id: startRFCExchange(t, "192.0.2.1"), Scram: rfcClientFinal}); code != http.StatusUnauthorized {
+		t.Fatalf("Hashed user: %d %v", code, output)
+	}
+}
+
+/* The verifier made for the users file is accepted by SCRAM and by the password check */
+func TestSCRAMVerifier(t *testing.T) {
+	verifier, err := TokensSCRAMVerifier("pencil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := tools.CheckPasswordHash(verifier, "pencil"); !ok || err != nil {
+		t.Fatalf("Verifier %s: %v", verifier, err)
+	}
+	if _, err = TokensSCRAMVerifier(""); err == nil {
+		t.Fatal("Verifier of an empty password")
+	}
+}
+
+/* A used challenge data does not count against the limit of its client */
+func TestSCRAMChallengeLimit(t *testing.T) {
+	setTestStore(t)
+	limit := challengeLimit
+	TokensSetChallengeLimit(2)
+	t.Cleanup(func() { TokensSetChallengeLimit(limit) })
+
+	id := startRFCExchange(t, "192.0.2.1")
+	startRFCExchange(t, "192.0.2.1")
+	if code, output := postSCRAM(t, TokensPostSCRAMStart, "192.0.2.1:1234", INPUTSCRAM{Scram: rfcClientFirst}); code != http.StatusTooManyRequests {
+		t.Fatalf("Third exchange: %d %v", code, output)
+	}
+	if code, output := postSCRAM(t, TokensPostSCRAMStart, "192.0.2.2:1234", INPUTSCRAM{Scram: rfcClientFirst}); code != http.StatusOK {
+		t.Fatalf("Exchange of another client: %d %v", code, output)
+	}
+	if _, err := useChallenge(id, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if code, output := postSCRAM(t, TokensPostSCRAMStart, "192.0.2.1:1234", INPUTSCRAM{Scram: rfcClientFirst}); code != http.StatusOK {
+		t.Fatalf("Exchange after a used one: %d %v", code, output)
+	}
+}
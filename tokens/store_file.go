@@ -0,0 +1,344 @@
+package tokens
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/* The buckets of the file store */
+var (
+	bucketTokens        = []byte("tokens")
+	bucketValues        = []byte("values")
+	bucketChallengeData = []byte("challengedata")
+	bucketUsedData      = []byte("usedchallengedata") /* the tombstones of the used challenge data */
+)
+
+/* The file store
+ * Tokens and challenge data are kept in an embedded on-disk database
+ */
+type FileStore struct {
+	db *bolt.DB
+}
+
+/* Open (or create) the database file */
+func NewFileStore(file string) (*FileStore, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketTokens, bucketValues, bucketChallengeData, bucketUsedData} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &FileStore{db: db}, nil
+}
+
+func (f *FileStore) Close() error {
+	return f.db.Close()
+}
+
+func getToken(tx *bolt.Tx, id []byte) (TOKEN, error) {
+	var item TOKEN
+	v := tx.Bucket(bucketTokens).Get(id)
+	if v == nil {
+		return item, ErrNotFound
+	}
+	err := json.Unmarshal(v, &item)
+	return item, err
+}
+
+func putToken(tx *bolt.Tx, item TOKEN) error {
+	v, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(bucketTokens).Put([]byte(item.Id), v); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketValues).Put([]byte(item.Token), []byte(item.Id))
+}
+
+func deleteToken(tx *bolt.Tx, item TOKEN) error {
+	if err := tx.Bucket(bucketValues).Delete([]byte(item.Token)); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTokens).Delete([]byte(item.Id))
+}
+
+func (f *FileStore) Create(item TOKEN) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		if old, err := getToken(tx, []byte(item.Id)); err == nil {
+			if err = deleteToken(tx, old); err != nil {
+				return err
+			}
+		}
+		return putToken(tx, item)
+	})
+}
+
+func (f *FileStore) Get(id string) (TOKEN, error) {
+	var item TOKEN
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		item, err = getToken(tx, []byte(id))
+		return err
+	})
+	return item, err
+}
+
+func (f *FileStore) GetByValue(token string) (TOKEN, error) {
+	var item TOKEN
+	err := f.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketValues).Get([]byte(token))
+		if id == nil {
+			return ErrNotFound
+		}
+		var err error
+		item, err = getToken(tx, id)
+		return err
+	})
+	return item, err
+}
+
+/* Increment hits and set the last update time of a token */
+func (f *FileStore) Touch(id string, now int64) (TOKEN, error) {
+	var item TOKEN
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if item, err = getToken(tx, []byte(id)); err != nil {
+			return err
+		}
+		item.Hits = item.Hits + 1
+		item.Updated = now
+		return putToken(tx, item)
+	})
+	return item, err
+}
+
+/* Mark a refresh token as used, ErrTokenUsed if it was already used */
+func (f *FileStore) Redeem(id string, now int64) (TOKEN, error) {
+	var item TOKEN
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if item, err = getToken(tx, []byte(id)); err != nil {
+			return err
+		}
+		if item.Used > 0 {
+			return ErrTokenUsed
+		}
+		item.Hits = item.Hits + 1
+		item.Used = now
+		return putToken(tx, item)
+	})
+	return item, err
+}
+
+func (f *FileStore) Delete(id string) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		item, err := getToken(tx, []byte(id))
+		if err != nil {
+			return err
+		}
+		return deleteToken(tx, item)
+	})
+}
+
+/* List the tokens, ordered by creation date */
+func (f *FileStore) List() ([]TOKEN, error) {
+	list := []TOKEN{}
+	err := f.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTokens).ForEach(func(k, v []byte) error {
+			var item TOKEN
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			list = append(list, item)
+			return nil
+		})
+	})
+	sortTokens(list)
+	return list, err
+}
+
+/* Remove the tokens expired at now (ttl is the default lifetime), and return them */
+func (f *FileStore) Expire(now, ttl int64) ([]TOKEN, error) {
+	var removed []TOKEN
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketTokens).ForEach(func(k, v []byte) error {
+			var item TOKEN
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			if item.ExpiresAt(ttl) < now {
+				removed = append(removed, item)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, item := range removed {
+			if err = deleteToken(tx, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+/* Remove the tokens of a refresh family, and return them */
+func (f *FileStore) DeleteFamily(family string) ([]TOKEN, error) {
+	if len(family) == 0 {
+		return nil, nil
+	}
+	return f.deleteTokens(func(item TOKEN) bool { return item.Family == family })
+}
+
+/* Remove the tokens of a user of the users list (not the client tokens, nor those of an external user), and return them */
+func (f *FileStore) DeleteUserTokens(user string) ([]TOKEN, error) {
+	return f.deleteTokens(func(item TOKEN) bool { return item.User == user && len(item.Client) == 0 && len(item.Source) == 0 })
+}
+
+func (f *FileStore) deleteTokens(match func(TOKEN) bool) ([]TOKEN, error) {
+	var removed []TOKEN
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketTokens).ForEach(func(k, v []byte) error {
+			var item TOKEN
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			if match(item) {
+				removed = append(removed, item)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, item := range removed {
+			if err = deleteToken(tx, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (f *FileStore) CreateChallenge(item CHALLENGEDATA) error {
+	v, err := json.Marshal(challengeRecord(item))
+	if err != nil {
+		return err
+	}
+	return f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketChallengeData).Put([]byte(item.Id), v)
+	})
+}
+
+func (f *FileStore) GetChallenge(id string) (CHALLENGEDATA, error) {
+	var item CHALLENGEDATA
+	err := f.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketChallengeData).Get([]byte(id))
+		if v == nil {
+			if tx.Bucket(bucketUsedData).Get([]byte(id)) != nil {
+				return ErrChallengeReplayed
+			}
+			return ErrNotFound
+		}
+		return json.Unmarshal(v, (*challengeRecord)(&item))
+	})
+	return item, err
+}
+
+/* Remove a challenge data and keep its tombstone
+ * ErrChallengeReplayed if it was already used, ErrNotFound if it does not exist (anymore)
+ */
+func (f *FileStore) DeleteChallenge(id string) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketChallengeData)
+		v := b.Get([]byte(id))
+		if v == nil {
+			if tx.Bucket(bucketUsedData).Get([]byte(id)) != nil {
+				return ErrChallengeReplayed
+			}
+			return ErrNotFound
+		}
+		if err := tx.Bucket(bucketUsedData).Put([]byte(id), append([]byte{}, v...)); err != nil {
+			return err
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+/* Count the unused challenge data of a client address created since deadline */
+func (f *FileStore) CountChallenges(address string, deadline int64) (int, error) {
+	n := 0
+	err := f.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketChallengeData).ForEach(func(k, v []byte) error {
+			var item CHALLENGEDATA
+			if err := json.Unmarshal(v, (*challengeRecord)(&item)); err != nil {
+				return err
+			}
+			if item.Address == address && item.Created >= deadline {
+				n++
+			}
+			return nil
+		})
+	})
+	return n, err
+}
+
+/* Remove the challenge data created before deadline, and return them (not the tombstones) */
+func (f *FileStore) ExpireChallenges(deadline int64) ([]CHALLENGEDATA, error) {
+	var removed []CHALLENGEDATA
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketChallengeData, bucketUsedData} {
+			var expired []CHALLENGEDATA
+			b := tx.Bucket(name)
+			err := b.ForEach(func(k, v []byte) error {
+				var item CHALLENGEDATA
+				if err := json.Unmarshal(v, (*challengeRecord)(&item)); err != nil {
+					return err
+				}
+				if item.Created < deadline {
+					expired = append(expired, item)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, item := range expired {
+				if err = b.Delete([]byte(item.Id)); err != nil {
+					return err
+				}
+			}
+			if bytes.Equal(name, bucketChallengeData) {
+				removed = expired
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
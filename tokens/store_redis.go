@@ -0,0 +1,466 @@
+package tokens
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/* The redis store
+ * Tokens and challenge data are shared between instances through a server
+ * speaking the Redis protocol, keys expire natively after the expiration time
+ */
+type RedisStore struct {
+	client redis.UniversalClient
+	prefix string
+	ttl    time.Duration
+}
+
+/* Connect to a redis server from its URL (redis://[:password@]host:port/db) */
+func NewRedisStore(url string, ttl time.Duration) (*RedisStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err = client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return NewRedisStoreFromClient(client, ttl), nil
+}
+
+/* Use an already connected redis client */
+func NewRedisStoreFromClient(client redis.UniversalClient, ttl time.Duration) *RedisStore {
+	return &RedisStore{
+		client: client,
+		prefix: "gotokens:",
+		ttl:    ttl,
+	}
+}
+
+func (r *RedisStore) Close() error {
+	return r.client.Close()
+}
+
+func (r *RedisStore) tokenKey(id string) string {
+	return r.prefix + "token:" + id
+}
+
+func (r *RedisStore) valueKey(token string) string {
+	return r.prefix + "value:" + token
+}
+
+func (r *RedisStore) familyKey(family string) string {
+	return r.prefix + "family:" + family
+}
+
+func (r *RedisStore) userKey(user string) string {
+	return r.prefix + "user:" + user
+}
+
+/* The sorted set of the token ids by expiration date */
+func (r *RedisStore) expiryKey() string {
+	return r.prefix + "expiry"
+}
+
+func (r *RedisStore) challengeKey(id string) string {
+	return r.prefix + "challengedata:" + id
+}
+
+func (r *RedisStore) usedKey(id string) string {
+	return r.prefix + "usedchallengedata:" + id
+}
+
+func (r *RedisStore) addressKey(address string) string {
+	return r.prefix + "challengeaddress:" + address
+}
+
+func (r *RedisStore) getToken(ctx context.Context, getter redis.Cmdable, id string) (TOKEN, error) {
+	var item TOKEN
+	v, err := getter.Get(ctx, r.tokenKey(id)).Bytes()
+	if err == redis.Nil {
+		return item, ErrNotFound
+	} else if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal(v, &item)
+	return item, err
+}
+
+/* Add a token id to an index set, the set lives as long as its longest-lived token */
+const redisIndexScript = `redis.call('SADD', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1`
+
+/* Save a token, the keys live until the expiration date of the token
+ * The token is indexed by expiration date, by family, and by user if it is not a client token
+ */
+func (r *RedisStore) putToken(ctx context.Context, pipe redis.Pipeliner, item TOKEN) error {
+	v, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(time.Unix(item.ExpiresAt(int64(r.ttl/time.Second)), 0))
+	if ttl <= 0 {
+		ttl = time.Second
+	}
+	pipe.Set(ctx, r.tokenKey(item.Id), v, ttl)
+	pipe.Set(ctx, r.valueKey(item.Token), item.Id, ttl)
+	pipe.ZAdd(ctx, r.expiryKey(), &redis.Z{Score: float64(item.ExpiresAt(int64(r.ttl / time.Second))), Member: item.Id})
+	if len(item.Family) > 0 {
+		pipe.Eval(ctx, redisIndexScript, []string{r.familyKey(item.Family)}, item.Id, ttl.Milliseconds())
+	}
+	if len(item.Client) == 0 {
+		pipe.Eval(ctx, redisIndexScript, []string{r.userKey(item.User)}, item.Id, ttl.Milliseconds())
+	}
+	return nil
+}
+
+/* Create (or replace) a token, the value of a replaced token is removed from the index */
+func (r *RedisStore) Create(item TOKEN) error {
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			old, err := r.getToken(ctx, tx, item.Id)
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if len(old.Token) > 0 && old.Token != item.Token {
+					pipe.Del(ctx, r.valueKey(old.Token))
+				}
+				return r.putToken(ctx, pipe, item)
+			})
+			return err
+		}, r.tokenKey(item.Id))
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return redis.TxFailedErr
+}
+
+func (r *RedisStore) Get(id string) (TOKEN, error) {
+	return r.getToken(context.Background(), r.client, id)
+}
+
+func (r *RedisStore) GetByValue(token string) (TOKEN, error) {
+	ctx := context.Background()
+	id, err := r.client.Get(ctx, r.valueKey(token)).Result()
+	if err == redis.Nil {
+		return TOKEN{}, ErrNotFound
+	} else if err != nil {
+		return TOKEN{}, err
+	}
+	return r.getToken(ctx, r.client, id)
+}
+
+/* Increment hits and set the last update time of a token
+ * The update is retried if the token is modified by another instance meanwhile
+ */
+func (r *RedisStore) Touch(id string, now int64) (TOKEN, error) {
+	ctx := context.Background()
+	var item TOKEN
+	for i := 0; i < 10; i++ {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			var err error
+			if item, err = r.getToken(ctx, tx, id); err != nil {
+				return err
+			}
+			item.Hits = item.Hits + 1
+			item.Updated = now
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return r.putToken(ctx, pipe, item)
+			})
+			return err
+		}, r.tokenKey(id))
+		if err != redis.TxFailedErr {
+			return item, err
+		}
+	}
+	return item, redis.TxFailedErr
+}
+
+/* Mark a refresh token as used, ErrTokenUsed if it was already used
+ * As for Touch, the update is retried if the token is modified by another instance meanwhile,
+ * so that a refresh token is only redeemed once
+ */
+func (r *RedisStore) Redeem(id string, now int64) (TOKEN, error) {
+	ctx := context.Background()
+	var item TOKEN
+	for i := 0; i < 10; i++ {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			var err error
+			if item, err = r.getToken(ctx, tx, id); err != nil {
+				return err
+			}
+			if item.Used > 0 {
+				return ErrTokenUsed
+			}
+			item.Hits = item.Hits + 1
+			item.Used = now
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return r.putToken(ctx, pipe, item)
+			})
+			return err
+		}, r.tokenKey(id))
+		if err != redis.TxFailedErr {
+			return item, err
+		}
+	}
+	return item, redis.TxFailedErr
+}
+
+func (r *RedisStore) Delete(id string) error {
+	ctx := context.Background()
+	item, err := r.Get(id)
+	if err != nil {
+		return err
+	}
+	return r.deleteToken(ctx, item)
+}
+
+/* Remove the keys of a token, and its id from the expiration index */
+func (r *RedisStore) deleteToken(ctx context.Context, item TOKEN) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.tokenKey(item.Id), r.valueKey(item.Token))
+		pipe.ZRem(ctx, r.expiryKey(), item.Id)
+		return nil
+	})
+	return err
+}
+
+/* List the tokens, ordered by creation date */
+func (r *RedisStore) List() ([]TOKEN, error) {
+	ctx := context.Background()
+	list := []TOKEN{}
+	iter := r.client.Scan(ctx, 0, r.tokenKey("*"), 0).Iterator()
+	for iter.Next(ctx) {
+		v, err := r.client.Get(ctx, iter.Val()).Bytes()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var item TOKEN
+		if err = json.Unmarshal(v, &item); err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sortTokens(list)
+	return list, nil
+}
+
+/* Remove the tokens expired at now (ttl is the default lifetime), and return them
+ * Keys already expire natively: only the ids of the expiration index due at now (sooner with a shortened expiration time)
+ * are read, the ids of the keys already gone are removed from the index
+ */
+func (r *RedisStore) Expire(now, ttl int64) ([]TOKEN, error) {
+	ctx := context.Background()
+	max := now
+	if shortened := int64(r.ttl/time.Second) - ttl; shortened > 0 {
+		max += shortened
+	}
+	ids, err := r.client.ZRangeByScore(ctx, r.expiryKey(), &redis.ZRangeBy{Min: "-inf", Max: "(" + strconv.FormatInt(max, 10)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	var removed []TOKEN
+	for _, id := range ids {
+		item, err := r.Get(id)
+		if err == ErrNotFound {
+			if err = r.client.ZRem(ctx, r.expiryKey(), id).Err(); err != nil {
+				return removed, err
+			}
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		if item.ExpiresAt(ttl) < now {
+			if err = r.deleteToken(ctx, item); err != nil {
+				return removed, err
+			}
+			removed = append(removed, item)
+		}
+	}
+	return removed, nil
+}
+
+/* Remove the tokens of a refresh family, and return them */
+func (r *RedisStore) DeleteFamily(family string) ([]TOKEN, error) {
+	if len(family) == 0 {
+		return nil, nil
+	}
+	return r.deleteIndex(r.familyKey(family), func(item TOKEN) bool { return item.Family == family })
+}
+
+/* Remove the tokens of a user of the users list (not the client tokens, nor those of an external user), and return them */
+func (r *RedisStore) DeleteUserTokens(user string) ([]TOKEN, error) {
+	return r.deleteIndex(r.userKey(user), func(item TOKEN) bool { return item.User == user && len(item.Client) == 0 && len(item.Source) == 0 })
+}
+
+/* Remove the tokens of an index set
+ * Only the ids read are removed from the set, a token added meanwhile stays indexed
+ */
+func (r *RedisStore) deleteIndex(key string, match func(TOKEN) bool) ([]TOKEN, error) {
+	ctx := context.Background()
+	ids, err := r.client.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	var removed []TOKEN
+	for _, id := range ids {
+		item, err := r.Get(id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		if !match(item) {
+			continue
+		}
+		if err = r.deleteToken(ctx, item); err != nil {
+			return removed, err
+		}
+		removed = append(removed, item)
+	}
+	if len(ids) > 0 {
+		members := make([]interface{}, len(ids))
+		for i, id := range ids {
+			members[i] = id
+		}
+		err = r.client.SRem(ctx, key, members...).Err()
+	}
+	return removed, err
+}
+
+/* Save a challenge data, and add it to the sorted set of its client address scored by creation date (see CountChallenges) */
+func (r *RedisStore) CreateChallenge(item CHALLENGEDATA) error {
+	ctx := context.Background()
+	v, err := json.Marshal(challengeRecord(item))
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.challengeKey(item.Id), v, r.ttl)
+		pipe.ZAdd(ctx, r.addressKey(item.Address), &redis.Z{Score: float64(item.Created), Member: item.Id})
+		pipe.Expire(ctx, r.addressKey(item.Address), r.ttl)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisStore) GetChallenge(id string) (CHALLENGEDATA, error) {
+	var item CHALLENGEDATA
+	ctx := context.Background()
+	v, err := r.client.Get(ctx, r.challengeKey(id)).Bytes()
+	if err == redis.Nil {
+		return item, r.missingChallenge(ctx, r.client, id)
+	} else if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal(v, (*challengeRecord)(&item))
+	return item, err
+}
+
+/* The error of a missing challenge data: ErrChallengeReplayed if its tombstone exists, ErrNotFound otherwise */
+func (r *RedisStore) missingChallenge(ctx context.Context, getter redis.Cmdable, id string) error {
+	n, err := getter.Exists(ctx, r.usedKey(id)).Result()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrChallengeReplayed
+	}
+	return ErrNotFound
+}
+
+/* Remove a challenge data and keep its tombstone until the challenge data would have expired
+ * ErrChallengeReplayed if it was already used, ErrNotFound if it does not exist (anymore)
+ * Only one of concurrent callers removes the key, the others get ErrChallengeReplayed
+ */
+func (r *RedisStore) DeleteChallenge(id string) error {
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			v, err := tx.Get(ctx, r.challengeKey(id)).Bytes()
+			if err == redis.Nil {
+				return r.missingChallenge(ctx, tx, id)
+			} else if err != nil {
+				return err
+			}
+			var item CHALLENGEDATA
+			if err = json.Unmarshal(v, (*challengeRecord)(&item)); err != nil {
+				return err
+			}
+			ttl, err := tx.PTTL(ctx, r.challengeKey(id)).Result()
+			if err != nil {
+				return err
+			}
+			/* -1: no expiration */
+			if ttl <= 0 {
+				ttl = r.ttl
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, r.challengeKey(id))
+				pipe.Set(ctx, r.usedKey(id), 1, ttl)
+				pipe.ZRem(ctx, r.addressKey(item.Address), id)
+				return nil
+			})
+			return err
+		}, r.challengeKey(id))
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return redis.TxFailedErr
+}
+
+/* Count the unused challenge data of a client address created since deadline
+ * A used challenge data is removed from the sorted set of its client address, the sorted set expires with its last challenge data
+ */
+func (r *RedisStore) CountChallenges(address string, deadline int64) (int, error) {
+	n, err := r.client.ZCount(context.Background(), r.addressKey(address), strconv.FormatInt(deadline, 10), "+inf").Result()
+	return int(n), err
+}
+
+/* Remove the challenge data created before deadline, and return them */
+func (r *RedisStore) ExpireChallenges(deadline int64) ([]CHALLENGEDATA, error) {
+	ctx := context.Background()
+	var removed []CHALLENGEDATA
+	iter := r.client.Scan(ctx, 0, r.challengeKey("*"), 0).Iterator()
+	for iter.Next(ctx) {
+		v, err := r.client.Get(ctx, iter.Val()).Bytes()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		var item CHALLENGEDATA
+		if err = json.Unmarshal(v, (*challengeRecord)(&item)); err != nil {
+			return removed, err
+		}
+		if item.Created < deadline {
+			_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, iter.Val())
+				pipe.ZRem(ctx, r.addressKey(item.Address), item.Id)
+				return nil
+			})
+			if err != nil {
+				return removed, err
+			}
+			removed = append(removed, item)
+		}
+	}
+	return removed, iter.Err()
+}
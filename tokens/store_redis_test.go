@@ -0,0 +1,179 @@
+package tokens
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestRedisStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	s := NewRedisStoreFromClient(redis.NewClient(&redis.Options{Addr: server.Addr()}), 60*time.Second)
+	t.Cleanup(func() { s.Close() })
+	return s, server
+}
+
+func TestRedisStore(t *testing.T) {
+	s, _ := newTestRedisStore(t)
+	testStoreTokens(t, s)
+	testStoreRevoke(t, s)
+	testStoreChallenges(t, s)
+}
+
+func TestRedisStoreParallel(t *testing.T) {
+	s, _ := newTestRedisStore(t)
+	testStoreParallel(t, s)
+}
+
+/* The keys of a token live until its expiration date, the keys of a challenge data for the expiration time */
+func TestRedisStoreTTL(t *testing.T) {
+	s, server := newTestRedisStore(t)
+	now := time.Now().Unix()
+	if err := s.Create(TOKEN{Id: "id1", Token: "value1", Created: now, Updated: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(TOKEN{Id: "id2", Token: "value2", Created: now, Updated: now, Lifetime: 3600}); err != nil {
+		t.Fatal(err)
+	}
+	refresh := TOKEN{Id: "id3", Token: "value3", Created: now - 30, Updated: now - 30, Refresh: true, Lifetime: 120}
+	if err := s.Create(refresh); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]time.Duration{
+		s.tokenKey("id1"): 60 * time.Second, s.valueKey("value1"): 60 * time.Second,
+		s.tokenKey("id2"): 3600 * time.Second, s.tokenKey("id3"): 90 * time.Second,
+	} {
+		if ttl := server.TTL(key); ttl < expected-2*time.Second || ttl > expected {
+			t.Fatalf("TTL of %s: %v, expected %v", key, ttl, expected)
+		}
+	}
+
+	/* Touch moves the expiration of an access token, Redeem keeps the one of a refresh token */
+	server.FastForward(30 * time.Second)
+	if _, err := s.Touch("id1", now+30); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL(s.valueKey("value1")); ttl < 88*time.Second {
+		t.Fatalf("TTL after Touch: %v", ttl)
+	}
+	if _, err := s.Redeem("id3", now+30); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL(s.tokenKey("id3")); ttl > 90*time.Second {
+		t.Fatalf("TTL after Redeem: %v", ttl)
+	}
+	if _, err := s.Redeem("id3", now+31); err != ErrTokenUsed {
+		t.Fatalf("Redeem reuse: %v", err)
+	}
+
+	if err := s.CreateChallenge(CHALLENGEDATA{Id: "c1", Data: "data", Created: now, Address: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	server.FastForward(91 * time.Second)
+	if _, err := s.GetByValue("value1"); err != ErrNotFound {
+		t.Fatalf("GetByValue expired access token: %v", err)
+	}
+	if _, err := s.Get("id3"); err != ErrNotFound {
+		t.Fatalf("Get expired refresh token: %v", err)
+	}
+	if _, err := s.GetChallenge("c1"); err != ErrNotFound {
+		t.Fatalf("GetChallenge expired: %v", err)
+	}
+	if item, err := s.GetByValue("value2"); err != nil || item.Id != "id2" {
+		t.Fatalf("GetByValue with lifetime: %+v %v", item, err)
+	}
+	if list, err := s.List(); err != nil || len(list) != 1 {
+		t.Fatalf("List: %+v %v", list, err)
+	}
+}
+
+/* A challenge data used on one instance is a replay on another one, the count of a client lives for the expiration time */
+func TestRedisStoreChallenges(t *testing.T) {
+	s, server := newTestRedisStore(t)
+	other := NewRedisStoreFromClient(redis.NewClient(&redis.Options{Addr: server.Addr()}), 60*time.Second)
+	defer other.Close()
+	now := time.Now().Unix()
+	for _, id := range []string{"c1", "c2"} {
+		if err := s.CreateChallenge(CHALLENGEDATA{Id: id, Data: "data", Created: now, Address: "10.0.0.1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteChallenge("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.GetChallenge("c1"); err != ErrChallengeReplayed {
+		t.Fatalf("GetChallenge on another instance: %v", err)
+	}
+	if err := other.DeleteChallenge("c1"); err != ErrChallengeReplayed {
+		t.Fatalf("DeleteChallenge on another instance: %v", err)
+	}
+	if ttl := server.TTL(s.usedKey("c1")); ttl <= 0 || ttl > 60*time.Second {
+		t.Fatalf("TTL of the tombstone: %v", ttl)
+	}
+	if n, err := other.CountChallenges("10.0.0.1", now); err != nil || n != 1 {
+		t.Fatalf("CountChallenges on another instance: %d %v", n, err)
+	}
+
+	server.FastForward(30 * time.Second)
+	if err := s.CreateChallenge(CHALLENGEDATA{Id: "c3", Data: "data", Created: now + 30, Address: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.CountChallenges("10.0.0.1", now); err != nil || n != 2 {
+		t.Fatalf("CountChallenges: %d %v", n, err)
+	}
+	/* An expired challenge data is no more counted */
+	if n, err := s.CountChallenges("10.0.0.1", now+1); err != nil || n != 1 {
+		t.Fatalf("CountChallenges since: %d %v", n, err)
+	}
+	if members, err := server.ZMembers(s.addressKey("10.0.0.1")); err != nil || len(members) != 2 {
+		t.Fatalf("Challenge data of the address: %v %v", members, err)
+	}
+	/* The sorted set of the address expires with its last challenge data */
+	server.FastForward(61 * time.Second)
+	if n, err := s.CountChallenges("10.0.0.1", now+91); err != nil || n != 0 {
+		t.Fatalf("CountChallenges after the expiration time: %d %v", n, err)
+	}
+	if server.Exists(s.addressKey("10.0.0.1")) {
+		t.Fatal("Sorted set of the address not expired")
+	}
+	if _, err := s.GetChallenge("c1"); err != ErrNotFound {
+		t.Fatalf("GetChallenge expired tombstone: %v", err)
+	}
+}
+
+/* Expire only reads the tokens due in the expiration index */
+func TestRedisStoreExpireIndex(t *testing.T) {
+	s, server := newTestRedisStore(t)
+	now := time.Now().Unix()
+	for _, item := range []TOKEN{
+		{Id: "old", Token: "value1", Created: now - 100, Updated: now - 100},
+		{Id: "fresh", Token: "value2", Created: now, Updated: now},
+		{Id: "gone", Token: "value3", Created: now - 100, Updated: now - 100},
+	} {
+		if err := s.Create(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if members, err := server.ZMembers(s.expiryKey()); err != nil || len(members) != 3 {
+		t.Fatalf("Expiration index: %v %v", members, err)
+	}
+	/* The keys of gone expired natively */
+	server.Del(s.tokenKey("gone"))
+	removed, err := s.Expire(now, 60)
+	if err != nil || len(removed) != 1 || removed[0].Id != "old" {
+		t.Fatalf("Expire: %+v %v", removed, err)
+	}
+	if members, err := server.ZMembers(s.expiryKey()); err != nil || len(members) != 1 || members[0] != "fresh" {
+		t.Fatalf("Expiration index after Expire: %v %v", members, err)
+	}
+
+	/* A shortened expiration time */
+	if removed, err = s.Expire(now+31, 30); err != nil || len(removed) != 1 || removed[0].Id != "fresh" {
+		t.Fatalf("Expire with a shortened expiration time: %+v %v", removed, err)
+	}
+	if server.Exists(s.valueKey("value2")) {
+		t.Fatal("Value of an expired token kept")
+	}
+}
@@ -0,0 +1,438 @@
+package tokens
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	_ "github.com/glebarez/go-sqlite"
+	_ "github.com/lib/pq"
+)
+
+/* The versioned schema migrations, applied in order and only once
+ * The statements are written for both SQLite and PostgreSQL
+ */
+var sqlMigrations = []string{
+	/* 1: tokens and challenge data */
+	`CREATE TABLE tokens (
+		id VARCHAR(64) PRIMARY KEY,
+		"user" VARCHAR(255) NOT NULL,
+		token VARCHAR(255) NOT NULL UNIQUE,
+		address VARCHAR(255) NOT NULL,
+		created BIGINT NOT NULL,
+		updated BIGINT NOT NULL,
+		hits BIGINT NOT NULL DEFAULT 0
+	);
+	CREATE INDEX tokens_updated ON tokens (updated);
+	CREATE TABLE challengedata (
+		id VARCHAR(64) PRIMARY KEY,
+		data TEXT NOT NULL,
+		created BIGINT NOT NULL
+	);`,
+	/* 2: users */
+	`CREATE TABLE users (
+		login VARCHAR(255) PRIMARY KEY,
+		password VARCHAR(255) NOT NULL
+	);`,
+	/* 3: client tokens */
+	`ALTER TABLE tokens ADD COLUMN client VARCHAR(255) NOT NULL DEFAULT '';
+	ALTER TABLE tokens ADD COLUMN lifetime BIGINT NOT NULL DEFAULT 0;`,
+	/* 4: refresh tokens */
+	`ALTER TABLE tokens ADD COLUMN family VARCHAR(64) NOT NULL DEFAULT '';
+	ALTER TABLE tokens ADD COLUMN refresh BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE tokens ADD COLUMN used BIGINT NOT NULL DEFAULT 0;
+	CREATE INDEX tokens_family ON tokens (family);`,
+	/* 5: scopes, space-separated */
+	`ALTER TABLE tokens ADD COLUMN scopes TEXT NOT NULL DEFAULT '';`,
+	/* 6: user roles, space-separated */
+	`ALTER TABLE users ADD COLUMN roles TEXT NOT NULL DEFAULT '';`,
+	/* 7: challenge data bound to the client address */
+	`ALTER TABLE challengedata ADD COLUMN address VARCHAR(255) NOT NULL DEFAULT '';
+	CREATE INDEX challengedata_address ON challengedata (address);`,
+	/* 8: disabled users */
+	`ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;`,
+	/* 9: user display names */
+	`ALTER TABLE users ADD COLUMN name VARCHAR(255) NOT NULL DEFAULT '';`,
+	/* 10: tokens of a user (revocation) */
+	`CREATE INDEX tokens_user ON tokens ("user");`,
+	/* 11: tombstones of the used challenge data */
+	`ALTER TABLE challengedata ADD COLUMN used BOOLEAN NOT NULL DEFAULT FALSE;`,
+	/* 12: no password material in the users table, it is meant to be shared for reporting */
+	`ALTER TABLE users DROP COLUMN password;`,
+	/* 13: tokens of the external users, by authenticator */
+	`ALTER TABLE tokens ADD COLUMN source VARCHAR(255) NOT NULL DEFAULT '';`,
+}
+
+/* The SQL store
+ * Tokens, challenge data and users are kept in a relational database
+ * - sqlite: for single-node deployments
+ * - postgres: for shared deployments
+ */
+type SQLStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+/* Open the database and apply the missing migrations
+ * - dialect: sqlite or postgres
+ * - source: the file name for sqlite, the connection URL for postgres
+ */
+func NewSQLStore(dialect, source string) (*SQLStore, error) {
+	if dialect != "sqlite" && dialect != "postgres" {
+		return nil, errors.New("Unknown SQL dialect " + dialect)
+	}
+	db, err := sql.Open(dialect, source)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == "sqlite" {
+		/* SQLite only allows one writer at a time */
+		db.SetMaxOpenConns(1)
+	}
+	s := &SQLStore{db: db, dialect: dialect}
+	if err = s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+/* Use the dialect placeholders: ? for sqlite, $n for postgres */
+func (s *SQLStore) rebind(query string) string {
+	if s.dialect != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+/* Apply the migrations not yet recorded in schema_migrations */
+func (s *SQLStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var version int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqlMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range strings.Split(sqlMigrations[i], ";") {
+			if len(strings.TrimSpace(statement)) == 0 {
+				continue
+			}
+			if _, err = tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if _, err = tx.Exec(s.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const sqlTokenColumns = `id, "user", token, address, created, updated, hits, client, lifetime, family, refresh, used, scopes, source`
+
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanToken(row sqlScanner) (TOKEN, error) {
+	var item TOKEN
+	var scopes string
+	err := row.Scan(&item.Id, &item.User, &item.Token, &item.Address, &item.Created, &item.Updated, &item.Hits, &item.Client, &item.Lifetime, &item.Family, &item.Refresh, &item.Used, &scopes, &item.Source)
+	if err == sql.ErrNoRows {
+		return item, ErrNotFound
+	}
+	item.Scopes = parseScopes(scopes)
+	return item, err
+}
+
+func (s *SQLStore) queryTokens(query string, args ...interface{}) ([]TOKEN, error) {
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []TOKEN{}
+	for rows.Next() {
+		item, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+	return list, rows.Err()
+}
+
+func (s *SQLStore) Create(item TOKEN) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(s.rebind(`DELETE FROM tokens WHERE id = ?`), item.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(s.rebind(`INSERT INTO tokens (`+sqlTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		item.Id, item.User, item.Token, item.Address, item.Created, item.Updated, item.Hits, item.Client, item.Lifetime, item.Family, item.Refresh, item.Used, formatScopes(item.Scopes), item.Source)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) Get(id string) (TOKEN, error) {
+	return scanToken(s.db.QueryRow(s.rebind(`SELECT `+sqlTokenColumns+` FROM tokens WHERE id = ?`), id))
+}
+
+func (s *SQLStore) GetByValue(token string) (TOKEN, error) {
+	return scanToken(s.db.QueryRow(s.rebind(`SELECT `+sqlTokenColumns+` FROM tokens WHERE token = ?`), token))
+}
+
+/* Increment hits and set the last update time of a token */
+func (s *SQLStore) Touch(id string, now int64) (TOKEN, error) {
+	result, err := s.db.Exec(s.rebind(`UPDATE tokens SET hits = hits + 1, updated = ? WHERE id = ?`), now, id)
+	if err != nil {
+		return TOKEN{}, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return TOKEN{}, ErrNotFound
+	}
+	return s.Get(id)
+}
+
+/* Mark a refresh token as used, ErrTokenUsed if it was already used */
+func (s *SQLStore) Redeem(id string, now int64) (TOKEN, error) {
+	result, err := s.db.Exec(s.rebind(`UPDATE tokens SET hits = hits + 1, used = ? WHERE id = ? AND used = 0`), now, id)
+	if err != nil {
+		return TOKEN{}, err
+	}
+	item, err := s.Get(id)
+	if err != nil {
+		return item, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return item, ErrTokenUsed
+	}
+	return item, nil
+}
+
+func (s *SQLStore) Delete(id string) error {
+	result, err := s.db.Exec(s.rebind(`DELETE FROM tokens WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+/* List the tokens, ordered by creation date */
+func (s *SQLStore) List() ([]TOKEN, error) {
+	return s.queryTokens(`SELECT ` + sqlTokenColumns + ` FROM tokens ORDER BY created, id`)
+}
+
+/* Remove the tokens expired at now (ttl is the default lifetime), and return them */
+func (s *SQLStore) Expire(now, ttl int64) ([]TOKEN, error) {
+	removed, err := s.queryTokens(`SELECT `+sqlTokenColumns+` FROM tokens WHERE CASE WHEN refresh THEN created ELSE updated END + CASE WHEN lifetime > 0 THEN lifetime ELSE ? END < ?`, ttl, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range removed {
+		if _, err = s.db.Exec(s.rebind(`DELETE FROM tokens WHERE id = ?`), item.Id); err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
+
+/* Remove the tokens of a refresh family, and return them */
+func (s *SQLStore) DeleteFamily(family string) ([]TOKEN, error) {
+	if len(family) == 0 {
+		return nil, nil
+	}
+	return s.deleteTokens(`family = ?`, family)
+}
+
+/* Remove the tokens of a user of the users list (not the client tokens, nor those of an external user), and return them */
+func (s *SQLStore) DeleteUserTokens(user string) ([]TOKEN, error) {
+	return s.deleteTokens(`"user" = ? AND client = '' AND source = ''`, user)
+}
+
+/* Remove the tokens matching a condition in a single transaction, and return them */
+func (s *SQLStore) deleteTokens(where string, args ...interface{}) ([]TOKEN, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(s.rebind(`SELECT `+sqlTokenColumns+` FROM tokens WHERE `+where), args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var removed []TOKEN
+	for rows.Next() {
+		item, err := scanToken(rows)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		removed = append(removed, item)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err = tx.Exec(s.rebind(`DELETE FROM tokens WHERE `+where), args...); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return removed, tx.Commit()
+}
+
+func (s *SQLStore) CreateChallenge(item CHALLENGEDATA) error {
+	_, err := s.db.Exec(s.rebind(`INSERT INTO challengedata (id, data, created, address) VALUES (?, ?, ?, ?)`), item.Id, item.Data, item.Created, item.Address)
+	return err
+}
+
+func (s *SQLStore) GetChallenge(id string) (CHALLENGEDATA, error) {
+	var item CHALLENGEDATA
+	var used bool
+	err := s.db.QueryRow(s.rebind(`SELECT id, data, created, address, used FROM challengedata WHERE id = ?`), id).Scan(&item.Id, &item.Data, &item.Created, &item.Address, &used)
+	if err == sql.ErrNoRows {
+		return item, ErrNotFound
+	}
+	if err == nil && used {
+		return CHALLENGEDATA{}, ErrChallengeReplayed
+	}
+	return item, err
+}
+
+/* Mark a challenge data used, its row is kept as a tombstone
+ * ErrChallengeReplayed if it was already used, ErrNotFound if it does not exist (anymore)
+ */
+func (s *SQLStore) DeleteChallenge(id string) error {
+	result, err := s.db.Exec(s.rebind(`UPDATE challengedata SET used = TRUE WHERE id = ? AND NOT used`), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		if _, err = s.GetChallenge(id); err == nil {
+			err = ErrChallengeReplayed
+		}
+		return err
+	}
+	return nil
+}
+
+/* Count the unused challenge data of a client address created since deadline */
+func (s *SQLStore) CountChallenges(address string, deadline int64) (int, error) {
+	var n int
+	err := s.db.QueryRow(s.rebind(`SELECT COUNT(*) FROM challengedata WHERE address = ? AND created >= ? AND NOT used`), address, deadline).Scan(&n)
+	return n, err
+}
+
+/* Remove the challenge data created before deadline, and return them (not the tombstones) */
+func (s *SQLStore) ExpireChallenges(deadline int64) ([]CHALLENGEDATA, error) {
+	if _, err := s.db.Exec(s.rebind(`DELETE FROM challengedata WHERE created < ? AND used`), deadline); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(s.rebind(`SELECT id, data, created FROM challengedata WHERE created < ?`), deadline)
+	if err != nil {
+		return nil, err
+	}
+	var removed []CHALLENGEDATA
+	for rows.Next() {
+		var item CHALLENGEDATA
+		if err = rows.Scan(&item.Id, &item.Data, &item.Created); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		removed = append(removed, item)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, item := range removed {
+		if _, err = s.db.Exec(s.rebind(`DELETE FROM challengedata WHERE id = ?`), item.Id); err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
+
+/* Users, without their password */
+
+func (s *SQLStore) LoadUsers() (map[string]USER, error) {
+	rows, err := s.db.Query(`SELECT login, roles, name, disabled FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make(map[string]USER)
+	for rows.Next() {
+		var login, roles, name string
+		var disabled bool
+		if err = rows.Scan(&login, &roles, &name, &disabled); err != nil {
+			return nil, err
+		}
+		users[login] = USER{Roles: strings.Fields(roles), Name: name, Disabled: disabled}
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLStore) SaveUser(login string, user USER) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(s.rebind(`DELETE FROM users WHERE login = ?`), login); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec(s.rebind(`INSERT INTO users (login, roles, name, disabled) VALUES (?, ?, ?, ?)`), login, strings.Join(user.Roles, " "), user.Name, user.Disabled); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) DeleteUser(login string) error {
+	res, err := s.db.Exec(s.rebind(`DELETE FROM users WHERE login = ?`), login)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package tokens
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gotokens/tools"
+)
+
+func newTestSQLStore(t *testing.T, file string) *SQLStore {
+	s, err := NewSQLStore("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func schemaVersion(t *testing.T, s *SQLStore) int {
+	var version int
+	if err := s.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestSQLStore(t *testing.T) {
+	s := newTestSQLStore(t, filepath.Join(t.TempDir(), "tokens.sqlite"))
+	testStoreTokens(t, s)
+	testStoreRevoke(t, s)
+	testStoreChallenges(t, s)
+	testStoreParallel(t, s)
+}
+
+/* The migrations are applied once, the data is kept when the database is opened again */
+func TestSQLStoreMigrations(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.sqlite")
+	s, err := NewSQLStore("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := schemaVersion(t, s); version != len(sqlMigrations) {
+		t.Fatalf("Schema version %d, expected %d", version, len(sqlMigrations))
+	}
+	item := TOKEN{Id: "id1", User: "alice", Token: "value1", Created: 1000, Updated: 1000, Family: "f1", Refresh: true, Scopes: []string{"tokens:read"}}
+	if err = s.Create(item); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = newTestSQLStore(t, file)
+	var n int
+	if err = s.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&n); err != nil || n != len(sqlMigrations) {
+		t.Fatalf("Migrations applied again: %d %v", n, err)
+	}
+	if got, err := s.Get("id1"); err != nil || !reflect.DeepEqual(got, item) {
+		t.Fatalf("Get after reopen: %+v %v", got, err)
+	}
+}
+
+/* A database created by an older version is migrated, its rows get the default values */
+func TestSQLStoreMigrationsUpgrade(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.sqlite")
+	db, err := sql.Open("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := []string{`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY)`}
+	statements = append(statements, strings.Split(sqlMigrations[0]+";"+sqlMigrations[1], ";")...)
+	statements = append(statements,
+		`INSERT INTO schema_migrations (version) VALUES (1), (2)`,
+		`INSERT INTO tokens (id, "user", token, address, created, updated, hits) VALUES ('id1', 'alice', 'value1', '10.0.0.1', 1000, 1000, 3)`,
+		`INSERT INTO users (login, password) VALUES ('alice', 'secret')`)
+	for _, statement := range statements {
+		if len(strings.TrimSpace(statement)) == 0 {
+			continue
+		}
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	s := newTestSQLStore(t, file)
+	if version := schemaVersion(t, s); version != len(sqlMigrations) {
+		t.Fatalf("Schema version %d, expected %d", version, len(sqlMigrations))
+	}
+	if got, err := s.GetByValue("value1"); err != nil || got.Hits != 3 || got.Refresh || got.Lifetime != 0 || len(got.Scopes) != 0 {
+		t.Fatalf("GetByValue after upgrade: %+v %v", got, err)
+	}
+	users, err := s.LoadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, found := users["alice"]; !found || len(user.Password) > 0 || len(user.Roles) != 0 || user.Disabled {
+		t.Fatalf("LoadUsers after upgrade: %+v", users)
+	}
+}
+
+func TestSQLStoreUsers(t *testing.T) {
+	s := newTestSQLStore(t, filepath.Join(t.TempDir(), "tokens.sqlite"))
+	alice := USER{Password: "$2a$10$hash", Roles: []string{RoleAdmin, RoleOperator}, Name: "Alice", Disabled: true}
+	if err := s.SaveUser("alice", alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveUser("bob", USER{Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	alice.Disabled = false
+	if err := s.SaveUser("alice", alice); err != nil {
+		t.Fatal(err)
+	}
+	users, err := s.LoadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Password = ""
+	if _, found := users["bob"]; len(users) != 2 || !found || !reflect.DeepEqual(users["alice"], alice) {
+		t.Fatalf("LoadUsers: %+v", users)
+	}
+	/* The passwords are never written to the table */
+	if _, err = s.db.Exec(`SELECT password FROM users`); err == nil {
+		t.Fatal("Password column in the users table")
+	}
+	if err = s.DeleteUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.DeleteUser("bob"); err != ErrNotFound {
+		t.Fatalf("DeleteUser twice: %v", err)
+	}
+	if users, err = s.LoadUsers(); err != nil || len(users) != 1 {
+		t.Fatalf("LoadUsers after DeleteUser: %+v %v", users, err)
+	}
+}
+
+/* The users list is the reference of the store */
+func TestSyncUsers(t *testing.T) {
+	s := newTestSQLStore(t, filepath.Join(t.TempDir(), "tokens.sqlite"))
+	previousStore := store
+	tokenUsers.Lock()
+	previousUsers := tokenUsers.users
+	tokenUsers.users = map[string]USER{"alice": {Password: "secret", Roles: []string{RoleUser}}}
+	tokenUsers.Unlock()
+	TokensSetStore(s)
+	defer func() {
+		TokensSetStore(previousStore)
+		tokenUsers.Lock()
+		tokenUsers.users = previousUsers
+		tokenUsers.Unlock()
+	}()
+
+	if err := s.SaveUser("alice", USER{Password: "old", Roles: []string{RoleAdmin}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveUser("admin", USER{Password: "old", Roles: []string{RoleAdmin}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := TokensSyncUsers(); err != nil {
+		t.Fatal(err)
+	}
+	users, err := s.LoadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || !reflect.DeepEqual(users["alice"], USER{Roles: []string{RoleUser}}) {
+		t.Fatalf("Store users after sync: %+v", users)
+	}
+	if _, found := getTokenUser("admin"); found {
+		t.Fatal("User only in the store imported into the users list")
+	}
+}
+
+/* A reload applies the same rule as the startup: the users file wins over the store, an empty file is refused */
+func TestReloadUsersSync(t *testing.T) {
+	s := newTestSQLStore(t, filepath.Join(t.TempDir(), "tokens.sqlite"))
+	previousStore := store
+	TokensSetStore(s)
+	defer TokensSetStore(previousStore)
+	file := filepath.Join(t.TempDir(), "users.json")
+	setTestUsers(t, file, map[string]USER{})
+
+	if err := s.SaveUser("mallory", USER{Password: "old", Roles: []string{RoleAdmin}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tools.WriteToAllFile(file, map[string]USER{"alice": {Password: "secret"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := TokensReloadUsers(); err != nil {
+		t.Fatal(err)
+	}
+	users, err := s.LoadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := users["alice"]; len(users) != 1 || !found {
+		t.Fatalf("Store users after reload: %+v", users)
+	}
+
+	if err = os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = TokensReloadUsers(); err == nil {
+		t.Fatal("Empty users file accepted")
+	}
+	if _, found := getTokenUser("alice"); !found {
+		t.Fatal("Users list replaced by an empty users file")
+	}
+}
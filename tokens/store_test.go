@@ -0,0 +1,282 @@
+package tokens
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+/* Check the token methods of a store */
+func testStoreTokens(t *testing.T, s TokenStore) {
+	item := TOKEN{Id: "id1", User: "alice", Token: "value1", Created: 1000, Updated: 1000}
+	if err := s.Create(item); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get("id1"); err != nil || got.User != "alice" || got.Token != "value1" {
+		t.Fatalf("Get: %+v %v", got, err)
+	}
+	if got, err := s.GetByValue("value1"); err != nil || got.Id != "id1" {
+		t.Fatalf("GetByValue: %+v %v", got, err)
+	}
+	if _, err := s.Get("unknown"); err != ErrNotFound {
+		t.Fatalf("Get unknown: %v", err)
+	}
+	if _, err := s.GetByValue("unknown"); err != ErrNotFound {
+		t.Fatalf("GetByValue unknown: %v", err)
+	}
+
+	/* A new value replaces the old one in the index */
+	item.Token = "value2"
+	if err := s.Create(item); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetByValue("value1"); err != ErrNotFound {
+		t.Fatalf("GetByValue old value: %v", err)
+	}
+	if got, err := s.GetByValue("value2"); err != nil || got.Id != "id1" {
+		t.Fatalf("GetByValue new value: %+v %v", got, err)
+	}
+
+	if got, err := s.Touch("id1", 1010); err != nil || got.Hits != 1 || got.Updated != 1010 {
+		t.Fatalf("Touch: %+v %v", got, err)
+	}
+	if got, err := s.Get("id1"); err != nil || got.Hits != 1 || got.Updated != 1010 {
+		t.Fatalf("Get after Touch: %+v %v", got, err)
+	}
+	if _, err := s.Touch("unknown", 1010); err != ErrNotFound {
+		t.Fatalf("Touch unknown: %v", err)
+	}
+
+	refresh := TOKEN{Id: "id2", User: "alice", Token: "value3", Created: 1001, Updated: 1001, Refresh: true, Lifetime: 100, Family: "f1"}
+	if err := s.Create(refresh); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Redeem("id2", 1020); err != nil || got.Used != 1020 {
+		t.Fatalf("Redeem: %+v %v", got, err)
+	}
+	if _, err := s.Redeem("id2", 1030); err != ErrTokenUsed {
+		t.Fatalf("Redeem reuse: %v", err)
+	}
+	if _, err := s.Redeem("unknown", 1030); err != ErrNotFound {
+		t.Fatalf("Redeem unknown: %v", err)
+	}
+
+	if list, err := s.List(); err != nil || len(list) != 2 || list[0].Id != "id1" || list[1].Id != "id2" {
+		t.Fatalf("List: %+v %v", list, err)
+	}
+
+	/* id1 expires at 1010+60, id2 at 1001+100 */
+	if removed, err := s.Expire(1070, 60); err != nil || len(removed) != 0 {
+		t.Fatalf("Expire none: %+v %v", removed, err)
+	}
+	if removed, err := s.Expire(1071, 60); err != nil || len(removed) != 1 || removed[0].Id != "id1" {
+		t.Fatalf("Expire access token: %+v %v", removed, err)
+	}
+	if _, err := s.GetByValue("value2"); err != ErrNotFound {
+		t.Fatalf("GetByValue expired: %v", err)
+	}
+	if removed, err := s.Expire(1102, 60); err != nil || len(removed) != 1 || removed[0].Id != "id2" {
+		t.Fatalf("Expire refresh token: %+v %v", removed, err)
+	}
+
+	if err := s.Create(item); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("id1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("id1"); err != ErrNotFound {
+		t.Fatalf("Delete twice: %v", err)
+	}
+	if _, err := s.GetByValue("value2"); err != ErrNotFound {
+		t.Fatalf("GetByValue deleted: %v", err)
+	}
+}
+
+/* Check the removal of the tokens of a family and of a user */
+func testStoreRevoke(t *testing.T, s TokenStore) {
+	for _, item := range []TOKEN{
+		{Id: "a1", User: "alice", Token: "va1", Created: 1000, Updated: 1000, Family: "f1"},
+		{Id: "a2", User: "alice", Token: "va2", Created: 1000, Updated: 1000, Family: "f1", Refresh: true},
+		{Id: "a3", User: "alice", Token: "va3", Created: 1000, Updated: 1000, Family: "f2"},
+		{Id: "a4", User: "alice", Token: "va4", Created: 1000, Updated: 1000, Client: "alice"},
+		{Id: "a5", User: "alice", Token: "va5", Created: 1000, Updated: 1000, Source: "ldap"},
+		{Id: "b1", User: "bob", Token: "vb1", Created: 1000, Updated: 1000, Family: "f3"},
+		{Id: "c1", User: "app", Token: "vc1", Created: 1000, Updated: 1000, Client: "app"},
+	} {
+		if err := s.Create(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := s.DeleteFamily("f1")
+	if err != nil || len(removed) != 2 {
+		t.Fatalf("DeleteFamily: %+v %v", removed, err)
+	}
+	if _, err = s.GetByValue("va2"); err != ErrNotFound {
+		t.Fatalf("GetByValue revoked: %v", err)
+	}
+	if removed, err = s.DeleteFamily(""); err != nil || len(removed) != 0 {
+		t.Fatalf("DeleteFamily without family: %+v %v", removed, err)
+	}
+	if removed, err = s.DeleteUserTokens("alice"); err != nil || len(removed) != 1 || removed[0].Id != "a3" {
+		t.Fatalf("DeleteUserTokens: %+v %v", removed, err)
+	}
+	if removed, err = s.DeleteUserTokens("app"); err != nil || len(removed) != 0 {
+		t.Fatalf("DeleteUserTokens of a client: %+v %v", removed, err)
+	}
+	list, err := s.List()
+	if err != nil || len(list) != 4 || list[0].Id != "a4" || list[1].Id != "a5" || list[2].Id != "b1" || list[3].Id != "c1" {
+		t.Fatalf("List: %+v %v", list, err)
+	}
+	if list[1].Source != "ldap" || list[0].Source != "" {
+		t.Fatalf("Source of the tokens: %+v", list)
+	}
+	for _, item := range list {
+		if err = s.Delete(item.Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+/* Check the challenge data methods of a store */
+func testStoreChallenges(t *testing.T, s TokenStore) {
+	_, redis := s.(*RedisStore)
+	for i, address := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"} {
+		item := CHALLENGEDATA{Id: "c" + strconv.Itoa(i), Data: "data" + strconv.Itoa(i), Created: int64(1000 + i), Address: address}
+		if err := s.CreateChallenge(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := s.GetChallenge("c1"); err != nil || got.Data != "data1" || got.Address != "10.0.0.1" || got.Created != 1001 {
+		t.Fatalf("GetChallenge: %+v %v", got, err)
+	}
+	if _, err := s.GetChallenge("unknown"); err != ErrNotFound {
+		t.Fatalf("GetChallenge unknown: %v", err)
+	}
+	if n, err := s.CountChallenges("10.0.0.1", 1000); err != nil || n != 2 {
+		t.Fatalf("CountChallenges: %d %v", n, err)
+	}
+	if n, err := s.CountChallenges("10.0.0.1", 1001); err != nil || n != 1 {
+		t.Fatalf("CountChallenges since: %d %v", n, err)
+	}
+
+	/* A used challenge data leaves a tombstone, and is no more counted */
+	if err := s.DeleteChallenge("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetChallenge("c1"); err != ErrChallengeReplayed {
+		t.Fatalf("GetChallenge used: %v", err)
+	}
+	if err := s.DeleteChallenge("c1"); err != ErrChallengeReplayed {
+		t.Fatalf("DeleteChallenge twice: %v", err)
+	}
+	if err := s.DeleteChallenge("unknown"); err != ErrNotFound {
+		t.Fatalf("DeleteChallenge unknown: %v", err)
+	}
+	if n, err := s.CountChallenges("10.0.0.1", 1000); err != nil || n != 1 {
+		t.Fatalf("CountChallenges with a used one: %d %v", n, err)
+	}
+
+	if removed, err := s.ExpireChallenges(1002); err != nil || len(removed) != 1 || removed[0].Id != "c0" {
+		t.Fatalf("ExpireChallenges: %+v %v", removed, err)
+	}
+	if _, err := s.GetChallenge("c2"); err != nil {
+		t.Fatalf("GetChallenge kept: %v", err)
+	}
+	/* The tombstones of the redis store expire natively */
+	if _, err := s.GetChallenge("c1"); !redis && err != ErrNotFound {
+		t.Fatalf("GetChallenge expired tombstone: %v", err)
+	}
+}
+
+/* Hammer a store from several goroutines, to be run with go test -race */
+func testStoreParallel(t *testing.T, s TokenStore) {
+	const workers, count = 8, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				id := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				item := TOKEN{Id: id, User: "user" + strconv.Itoa(w), Token: "value" + id, Created: 1500, Updated: 1500}
+				if err := s.Create(item); err != nil {
+					errs <- err
+					return
+				}
+				/* A stale token, removed by the Expire of any worker */
+				if err := s.Create(TOKEN{Id: "stale" + id, Token: "stale" + id, Created: 1000, Updated: 1000}); err != nil {
+					errs <- err
+					return
+				}
+				if got, err := s.GetByValue(item.Token); err != nil || got.Id != id {
+					errs <- fmt.Errorf("GetByValue %s: %+v %v", id, got, err)
+					return
+				}
+				if _, err := s.Touch(id, 2000); err != nil {
+					errs <- err
+					return
+				}
+				/* Every other token is deleted, the others are expired below */
+				if i%2 == 0 {
+					if err := s.Delete(id); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if _, err := s.Expire(1500, 60); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != workers*count/2 {
+		t.Fatalf("List: %d tokens, expected %d", len(list), workers*count/2)
+	}
+	for _, item := range list {
+		if item.Hits != 1 || item.Updated != 2000 {
+			t.Fatalf("Touch lost: %+v", item)
+		}
+	}
+	if removed, err := s.Expire(2061, 60); err != nil || len(removed) != len(list) {
+		t.Fatalf("Expire: %d %v", len(removed), err)
+	}
+	if list, err = s.List(); err != nil || len(list) != 0 {
+		t.Fatalf("List after Expire: %d %v", len(list), err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStoreTokens(t, NewMemoryStore())
+	testStoreRevoke(t, NewMemoryStore())
+	testStoreChallenges(t, NewMemoryStore())
+}
+
+func TestMemoryStoreParallel(t *testing.T) {
+	testStoreParallel(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	s, err := NewFileStore(filepath.Join(t.TempDir(), "tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStoreTokens(t, s)
+	testStoreRevoke(t, s)
+	testStoreChallenges(t, s)
+	testStoreParallel(t, s)
+}
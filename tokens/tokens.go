@@ -1,12 +1,17 @@
 package tokens
 
 import (
-	"crypto/md5"
-	"fmt"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"log"
+	"net"
 	"net/http"
-	"strconv"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"gotokens/tools"
 
@@ -24,86 +29,368 @@ var (
 	TokenCode      = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
 )
 
+/* The token format: opaque (random value checked against the store), jwt, paseto-local or paseto-public (checked offline) */
+var tokenFormat = "opaque"
+
+/* Token generation: number of random bytes and encoding (hex, base64url, base32) */
+var (
+	tokenLength   int = 32
+	tokenEncoding     = "hex"
+)
+
 func TokensSetExpirationTime(ex int) {
 	expireTime = ex
 }
 
-/* The challenge data properties */
-type CHALLENGEDATA struct {
-	Id      string `json:"-"`
-	Data    string `json:"challengedata"`
-	Created int64  `json:"-"`
+/* The server secret used to hash the tokens at rest */
+var tokenSecret []byte
+
+/* Set the server secret, a random one is generated if empty
+ * (then the tokens saved by a persistent store are lost on restart)
+ * The user encoding code is derived from the secret, so that cookies survive a restart too
+ */
+func TokensSetSecret(secret string) {
+	if len(secret) == 0 {
+		log.Println("No secret given, tokens will not survive a restart")
+		secret, _ = tools.SecureRandom(32, "hex")
+	} else {
+		TokenCode = tools.KeyedShuffle(TokenCode, secret)
+	}
+	tokenSecret = []byte(secret)
 }
 
-/* The challenge data database */
-var ChallengeData []CHALLENGEDATA
+/* Load the server secret from a file, a random secret is created into the file (0600) if it does not exist
+ * A persistent store without -secret keeps its tokens through a restart with it
+ */
+func TokensLoadSecret(file string) error {
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		secret, err := tools.SecureRandom(32, "hex")
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			/* Created meanwhile by another instance */
+			return TokensLoadSecret(file)
+		} else if err != nil {
+			return err
+		}
+		if _, err = f.WriteString(secret + "\n"); err != nil {
+			f.Close()
+			os.Remove(file)
+			return err
+		}
+		if err = f.Close(); err != nil {
+			os.Remove(file)
+			return err
+		}
+		log.Println("Server secret created in " + file)
+		content = []byte(secret)
+	} else if err != nil {
+		return err
+	}
+	secret := strings.TrimSpace(string(content))
+	if len(secret) == 0 {
+		return errors.New("Empty secret file " + file)
+	}
+	TokensSetSecret(secret)
+	return nil
+}
 
-/* Get a challenge data (GET /challengedata)
+/* Set the token format
+ * - opaque: random tokens, validated against the store
+ * - jwt: signed JWT, validated with the signature and expiry only (see TokensSetJWT)
+ * - paseto-local: encrypted PASETO v4.local (see TokensSetPASETOLocalKey)
+ * - paseto-public: signed PASETO v4.public (see TokensSetPASETOPublicKey)
  */
-func TokensGetChallengeData(c *gin.Context) {
-	data := ""
-	now := tools.Epoch()
-	for i := 0; i < 16; i++ {
-		data = data + tools.Gensha256(strconv.FormatInt(now+int64(i), 10))
+func TokensSetTokenFormat(format string) error {
+	switch format {
+	case "opaque":
+	case "jwt":
+		if !jwtKeyReady() {
+			return errors.New("JWT signing key is not set")
+		}
+	case "paseto-local", "paseto-public":
+		if !pasetoKeyReady(format) {
+			return errors.New("PASETO key is not set")
+		}
+	default:
+		return errors.New("Unknown token format " + format)
 	}
-	id := tools.Genuuid()
-	item := CHALLENGEDATA{
-		Id:      id,
-		Data:    data,
-		Created: now,
+	tokenFormat = format
+	return nil
+}
+
+/* Set the token generation parameters
+ * - length: number of random bytes
+ * - encoding: hex, base64url or base32
+ */
+func TokensSetTokenEncoding(length int, encoding string) error {
+	if _, err := tools.SecureRandom(length, encoding); err != nil {
+		return err
 	}
-	ChallengeData = append(ChallengeData, item)
-	c.SetCookie("ChallengeData", id, tokenTTL, "/", tools.Replace(":[0-9]*$", "", c.Request.Host), false, true)
-	c.JSON(http.StatusOK, item)
+	tokenLength = length
+	tokenEncoding = encoding
+	return nil
+}
+
+/* Return the keyed hash of a token value, only this hash is saved into the store */
+func hashToken(token string) string {
+	return tools.HMACSHA256(tokenSecret, token)
+}
+
+/* The challenge data properties, holding the messages of a SCRAM exchange (see scram.go) */
+type CHALLENGEDATA struct {
+	Id      string `json:"-"`
+	Data    string `json:"challengedata"`
+	Created int64  `json:"-"`
+	Address string `json:"-"` /* the client address the challenge data is bound to */
 }
 
 /* The token properties */
 type TOKEN struct {
 	Id      string `json:"id"`
 	User    string `json:"user"`
-	Token   string `json:"token"`
+	Token   string `json:"token"` /* keyed hash of the token, the plain token is only returned on creation */
 	Address string `json:"address"`
 	Created int64  `json:"created"`
 	Updated int64  `json:"updated"`
 	Hits    int64  `json:"hits"`
+	/* Tokens issued to a client (client credentials grant) */
+	Client   string `json:"client,omitempty"`
+	Lifetime int64  `json:"lifetime,omitempty"` /* in seconds, the expiration time if null */
+	/* Tokens of an external user: its authenticator (htpasswd, ldap), empty for the users list */
+	Source string `json:"source,omitempty"`
+	/* Refresh tokens: the access and refresh tokens of a login share the same family */
+	Family       string   `json:"family,omitempty"`
+	Refresh      bool     `json:"refresh,omitempty"`       /* a refresh token, not usable as access token */
+	Used         int64    `json:"used,omitempty"`          /* date of use of a refresh token */
+	RefreshToken string   `json:"refresh_token,omitempty"` /* the plain refresh token, only returned on creation */
+	Scopes       []string `json:"scopes,omitempty"`        /* the granted scopes (see scopes.go) */
 }
 
-/* The tokens database */
-var Tokens []TOKEN
+/* Return the expiration date of a token, ttl is the default lifetime
+ * A refresh token expires from its creation date, an access token from its last update
+ */
+func (t TOKEN) ExpiresAt(ttl int64) int64 {
+	from := t.Updated
+	if t.Refresh {
+		from = t.Created
+	}
+	if t.Lifetime > 0 {
+		return from + t.Lifetime
+	}
+	return from + ttl
+}
 
-/* The users list that are authorized to create a token : map[login] => password */
-var tokenUsers map[string]string
+/* The user properties, read from JSON, YAML, TOML or INI (see TokensLoadUsers) */
+type USER struct {
+	Password string   `json:"password" toml:"password"`                     /* a $id$ prefixed hash (bcrypt, argon2id, scrypt), or plaintext (deprecated) */
+	Roles    []string `json:"roles,omitempty" toml:"roles,omitempty"`       /* see roles.go, user if empty */
+	Name     string   `json:"name,omitempty" toml:"name,omitempty"`         /* display name */
+	Disabled bool     `json:"disabled,omitempty" toml:"disabled,omitempty"` /* a disabled user can not authenticate */
+}
 
-func AddTokenUser(login, password string) {
-	tokenUsers[login] = password
+/* Read a user from {"password":"xxx","roles":["admin"]}, or from a single password (former format) */
+func (u *USER) UnmarshalJSON(data []byte) error {
+	var password string
+	if err := json.Unmarshal(data, &password); err == nil {
+		*u = USER{Password: password}
+		return nil
+	}
+	type user USER
+	return json.Unmarshal(data, (*user)(u))
+}
+
+/* Read a user from a single password (TOML) */
+func (u *USER) UnmarshalText(data []byte) error {
+	*u = USER{Password: string(data)}
+	return nil
+}
+
+/* The users list that are authorized to create a token : map[login] => user
+ * The users added with AddTokenUser (command line) are not written back to the users file,
+ * the users file keeps its own record of a login overridden from the command line (file)
+ */
+var tokenUsers = struct {
+	sync.RWMutex
+	users map[string]USER
+	added map[string]bool
+	file  map[string]USER
+}{users: make(map[string]USER), added: make(map[string]bool), file: make(map[string]USER)}
+
+func AddTokenUser(login, password string, roles ...string) {
+	user := USER{Password: password, Roles: roles}
+	checkUser(login, user)
+	tokenUsers.Lock()
+	tokenUsers.users[login] = user
+	tokenUsers.added[login] = true
+	tokenUsers.Unlock()
+}
+
+/* Log the problems of a user: unknown roles, plaintext password */
+func checkUser(login string, user USER) {
+	for _, role := range user.Roles {
+		if !validRole(role) {
+			log.Println("Unknown role " + role + " for user " + login)
+		}
+	}
+	if !tools.IsPasswordHash(user.Password) {
+		log.Println("Warning: plaintext password for user " + login + ", it should be a SCRAM-SHA-256 verifier (tokens users scram), a bcrypt, argon2id or scrypt hash can not be used with SCRAM")
+	}
+}
+
+/* Check the password of a user, against its hash or its plaintext password, in constant time
+ * A disabled user is always refused
+ */
+func checkPassword(login string, user USER, password string) bool {
+	if user.Disabled {
+		log.Println("Disabled user " + login)
+		return false
+	}
+	if tools.IsPasswordHash(user.Password) {
+		ok, err := tools.CheckPasswordHash(user.Password, password)
+		if err != nil {
+			log.Println("Wrong password hash for user " + login + ": " + err.Error())
+		}
+		return ok
+	}
+	return subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
 }
 
-/* We read the users list from file */
+/* Get a user from its login */
+func getTokenUser(login string) (USER, bool) {
+	tokenUsers.RLock()
+	defer tokenUsers.RUnlock()
+	user, found := tokenUsers.users[login]
+	return user, found
+}
+
+/* Synchronize the store with the users list, if it can keep users
+ * The users list is the reference: its users are saved into the store (without their password), the users only in the store are removed
+ */
+func TokensSyncUsers() error {
+	users, ok := store.(UserStore)
+	if !ok {
+		return nil
+	}
+	saved, err := users.LoadUsers()
+	if err != nil {
+		return err
+	}
+	tokenUsers.RLock()
+	list := make(map[string]USER, len(tokenUsers.users))
+	for login, user := range tokenUsers.users {
+		user.Password = ""
+		list[login] = user
+	}
+	tokenUsers.RUnlock()
+	for login, user := range list {
+		if previous, found := saved[login]; !found || !reflect.DeepEqual(previous, user) {
+			if err = users.SaveUser(login, user); err != nil {
+				return err
+			}
+		}
+	}
+	for login := range saved {
+		if _, found := list[login]; !found {
+			log.Println("Remove user " + login + " from the store")
+			if err = users.DeleteUser(login); err != nil && err != ErrNotFound {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/* We set a random token code and server secret */
 func init() {
-	TokenCode = tools.Shuffle(TokenCode)
-	tokenUsers = make(map[string]string)
-	tools.ReadFromJSONFile("users.json", &tokenUsers)
+	if code, err := tools.SecureShuffle(TokenCode); err == nil {
+		TokenCode = code
+	}
+	if secret, err := tools.SecureRandom(32, "hex"); err == nil {
+		tokenSecret = []byte(secret)
+	}
+}
+
+/* The address of the client of a request, from the X-Forwarded-For header if sent by a trusted proxy (see -trusted-proxies) */
+func clientAddress(c *gin.Context) string {
+	return c.ClientIP()
+}
+
+/* Test if a token is expired */
+func tokenExpired(item TOKEN, now int64) bool {
+	return item.ExpiresAt(int64(expireTime)) < now
 }
 
 /* Clean token and challenge data database on expiration date */
 func TokensClean() {
 	now := tools.Epoch()
-	if len(Tokens) > 0 {
-		for i := 0; i < len(Tokens); i++ {
-			if (Tokens[i].Updated + int64(expireTime)) < now {
-				log.Println("Remove token " + Tokens[i].Token)
-				Tokens = append(Tokens[:i], Tokens[i+1:]...)
-			}
+	deadline := now - int64(expireTime)
+	if removed, err := store.Expire(now, int64(expireTime)); err == nil {
+		for _, item := range removed {
+			log.Println("Remove token " + item.Token)
 		}
+	} else {
+		log.Println("Can not clean tokens: " + err.Error())
 	}
-	if len(ChallengeData) > 0 {
-		for i := 0; i < len(ChallengeData); i++ {
-			if (ChallengeData[i].Created + int64(expireTime)) < now {
-				log.Println("Remove challentge data " + ChallengeData[i].Data)
-				ChallengeData = append(ChallengeData[:i], ChallengeData[i+1:]...)
-			}
+	if removed, err := store.ExpireChallenges(deadline); err == nil {
+		for _, item := range removed {
+			log.Println("Remove challentge data " + item.Data)
+		}
+	} else {
+		log.Println("Can not clean challenge data: " + err.Error())
+	}
+	pruneJWTKeys(tools.Epoch())
+}
+
+/* Validate a stateless token (PASETO, or JWT when the token format is jwt)
+ * Return the token properties from its claims, its expiration date and whether the token is stateless
+ */
+func validateStateless(token string) (TOKEN, int64, bool, error) {
+	if isPASETO(token) {
+		claims, err := validatePASETO(token)
+		if err != nil {
+			return TOKEN{}, 0, true, err
+		}
+		exp, _ := time.Parse(time.RFC3339, claims.Expiration)
+		return TOKEN{
+			Id:      claims.Id,
+			User:    claims.User,
+			Address: claims.Address,
+			Created: claims.Created,
+			Updated: claims.Updated,
+			Hits:    claims.Hits,
+			Client:  claims.Client,
+			Source:  claims.Source,
+			Scopes:  parseScopes(claims.Scope),
+		}, exp.Unix(), true, nil
+	}
+	if tokenFormat == "jwt" && isJWT(token) {
+		claims, err := validateJWT(token)
+		if err != nil {
+			return TOKEN{}, 0, true, err
+		}
+		item := TOKEN{
+			Id:      claims.ID,
+			User:    claims.Subject,
+			Address: claims.Address,
+			Client:  claims.Client,
+			Source:  claims.Source,
+			Scopes:  parseScopes(claims.Scope),
+		}
+		if claims.IssuedAt != nil {
+			item.Created = claims.IssuedAt.Unix()
+			item.Updated = item.Created
 		}
+		var exp int64
+		if claims.ExpiresAt != nil {
+			exp = claims.ExpiresAt.Unix()
+		}
+		return item, exp, true, nil
 	}
+	return TOKEN{}, 0, false, nil
 }
 
 /* Validate a given userToken (see TestToken func below)
@@ -112,42 +399,65 @@ func TokensClean() {
  * return is false => the token is invalid or unknown
  */
 func TokensValidate(userToken string) bool {
-	test := false
-	now := tools.Epoch()
-	userTokenSplit := strings.Split(userToken, "-")
+	_, test := validateUserToken(userToken)
+	return test
+}
+
+/* Validate a given userToken, and return the token properties */
+func validateUserToken(userToken string) (TOKEN, bool) {
+	userTokenSplit := strings.SplitN(userToken, "-", 2)
 	if len(userTokenSplit) != 2 {
-		return false
+		return TOKEN{}, false
 	}
 	user, _ := tools.StringDecode(userTokenSplit[0], TokenCode)
-	token := userTokenSplit[1]
-	if len(Tokens) > 0 {
-		for i := 0; i < len(Tokens); i++ {
-			if (user == Tokens[i].User) && (token == Tokens[i].Token) {
-				if (Tokens[i].Updated + int64(expireTime)) < now {
-					log.Println("Remove token " + Tokens[i].Token)
-					Tokens = append(Tokens[:i], Tokens[i+1:]...)
-				} else {
-					test = true
-					Tokens[i].Hits = Tokens[i].Hits + 1
-					Tokens[i].Updated = now
-					log.Println("Token validated for user " + user)
-					break
-				}
-			}
+	return validateToken(userTokenSplit[1], user, true)
+}
+
+/* Validate a bearer token, a plain token value without user (see TestToken func below) */
+func TokensValidateBearer(token string) bool {
+	_, test := validateToken(token, "", false)
+	return test
+}
+
+/* Validate a token value, owned by user if checkUser is set
+ * Return the token properties and whether the token is valid
+ */
+func validateToken(token, user string, checkUser bool) (TOKEN, bool) {
+	now := tools.Epoch()
+	if item, _, stateless, err := validateStateless(token); stateless {
+		/* Signed or encrypted token: no store lookup */
+		if err == nil && (!checkUser || user == item.User) {
+			log.Println("Token validated for user " + item.User)
+			return item, true
 		}
-	}
-	if !test {
 		log.Println("Token is not valid")
+		return TOKEN{}, false
 	}
-	return test
+	if item, err := store.GetByValue(hashToken(token)); err == nil && !item.Refresh && (!checkUser || user == item.User) {
+		if tokenExpired(item, now) {
+			log.Println("Remove token " + item.Token)
+			store.Delete(item.Id)
+		} else if item, err = store.Touch(item.Id, now); err == nil {
+			log.Println("Token validated for user " + item.User)
+			return item, true
+		}
+	}
+	log.Println("Token is not valid")
+	return TOKEN{}, false
 }
 
 /* Test the userToken received from client (in query, cookie or header)
  * A userToken is in the form user-token
  * The userToken is passed to TokensValidate func above
+ * Without userToken, a bearer token (Authorization: Bearer token) is passed to TokensValidateBearer
  */
 func TestToken(c *gin.Context) bool {
-	test := false
+	_, test := authToken(c)
+	return test
+}
+
+/* Test the token of the request as TestToken, and return the token properties */
+func authToken(c *gin.Context) (TOKEN, bool) {
 	userToken, b := c.GetQuery("token")
 	if !b {
 		userToken = ""
@@ -161,77 +471,84 @@ func TestToken(c *gin.Context) bool {
 		userToken = c.GetHeader("TOKEN")
 	}
 	if len(userToken) > 0 {
-		test = TokensValidate(userToken)
+		return validateUserToken(userToken)
+	} else if bearer := c.GetHeader("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+		return validateToken(strings.TrimPrefix(bearer, "Bearer "), "", false)
 	}
-	return test
+	return TOKEN{}, false
 }
 
 /* API */
 
 /* Get all the tokens (GET /tokens)
- * with auth
+ * with auth, scope tokens:read, only its own tokens without scope tokens:all
  * 401 -> Unauthorized
+ * 403 -> Missing scope
  * 200 -> Ok
  */
 func TokensGet(c *gin.Context) {
-	if !TestToken(c) {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized"})
+	caller, ok := testTokenScope(c, ScopeTokensRead)
+	if !ok {
 		return
 	}
-	c.JSON(http.StatusOK, Tokens)
+	list, err := store.List()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	owned := []TOKEN{}
+	for _, item := range list {
+		if canAccessToken(caller, item) {
+			owned = append(owned, item)
+		}
+	}
+	c.JSON(http.StatusOK, owned)
 }
 
 /* Get one token (GET /tokens/:id)
- * with auth
+ * with auth, scope tokens:read, only its own tokens without scope tokens:all
  * 401 -> Unauthorized
+ * 403 -> Missing scope
  * 404 -> Not found
  * 200 -> Ok
  */
 func TokensGetId(c *gin.Context) {
-	if !TestToken(c) {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized"})
+	caller, ok := testTokenScope(c, ScopeTokensRead)
+	if !ok {
 		return
 	}
 	id := c.Param("id")
 	now := tools.Epoch()
-	if len(Tokens) > 0 {
-		for i := 0; i < len(Tokens); i++ {
-			if id == Tokens[i].Id {
-				if (Tokens[i].Updated + int64(expireTime)) < now {
-					log.Println("Remove token " + Tokens[i].Token)
-					Tokens = append(Tokens[:i], Tokens[i+1:]...)
-				} else {
-					Tokens[i].Hits = Tokens[i].Hits + 1
-					Tokens[i].Updated = now
-					c.JSON(http.StatusOK, Tokens[i])
-					return
-				}
-			}
+	if item, err := store.Get(id); err == nil && canAccessToken(caller, item) {
+		if tokenExpired(item, now) {
+			log.Println("Remove token " + item.Token)
+			store.Delete(item.Id)
+		} else if item, err = store.Touch(item.Id, now); err == nil {
+			c.JSON(http.StatusOK, item)
+			return
 		}
 	}
 	c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": "failed", "message": "Not found"})
 }
 
 /* Delete one token (DELETE /tokens/:id)
- * with auth
+ * with auth, scope tokens:delete, only its own tokens without scope tokens:all
  * 401 -> Unauthorized
+ * 403 -> Missing scope
  * 404 -> Not found
  * 204 -> Deleted
  */
 func TokensDeleteId(c *gin.Context) {
-	if !TestToken(c) {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized"})
+	caller, ok := testTokenScope(c, ScopeTokensDelete)
+	if !ok {
 		return
 	}
 	id := c.Param("id")
-	if len(Tokens) > 0 {
-		for i := 0; i < len(Tokens); i++ {
-			if id == Tokens[i].Id {
-				log.Println("Remove token " + Tokens[i].Token)
-				Tokens = append(Tokens[:i], Tokens[i+1:]...)
-				c.Status(http.StatusNoContent)
-				return
-			}
+	if item, err := store.Get(id); err == nil && canAccessToken(caller, item) {
+		if err = store.Delete(item.Id); err == nil {
+			log.Println("Remove token " + item.Token)
+			c.Status(http.StatusNoContent)
+			return
 		}
 	}
 	c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": "failed", "message": "Not found"})
@@ -241,23 +558,26 @@ func TokensSetCookie(c *gin.Context, login, token string) {
 	c.SetCookie("Token", tools.StringEncode(login, token)+"-"+token, tokenTTL, "/", tools.Replace(":[0-9]*$", "", c.Request.Host), false, true)
 }
 
-/* Validate one token (GET /validate/:token)
+/* Validate one token (GET /validate/:token), with an optional required scope (?scope=tokens:read)
  * no auth
  * 200 -> Ok
+ * 403 -> Missing scope
  * 404 -> Not found or invalid
  */
 func TokensGetValidate(c *gin.Context) {
 	token := c.Param("token")
-	test := false
-	if len(Tokens) > 0 {
-		for i := 0; i < len(Tokens); i++ {
-			if token == Tokens[i].Token {
-				test = true
-				break
-			}
+	item, _, stateless, err := validateStateless(token)
+	if !stateless {
+		if item, err = store.GetByValue(hashToken(token)); err == nil && item.Refresh {
+			err = ErrNotFound
 		}
 	}
-	if test {
+	if scope := c.Query("scope"); err == nil && len(scope) > 0 && !hasScope(item.Scopes, scope) {
+		log.Println("Token is valid, but misses scope " + scope)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "failed", "message": "Forbidden, missing scope " + scope})
+		return
+	}
+	if err == nil {
 		TokensSetCookie(c, "Unknown", token)
 		//c.SetCookie("Token", tools.StringEncode("Unknown", token)+"-"+token, tokenTTL, "/", tools.Replace(":[0-9]*$", "", c.Request.Host), false, true)
 		log.Println("Token is valid")
@@ -272,9 +592,12 @@ func TokensGetValidate(c *gin.Context) {
 type INPUTCREDENTIALS struct {
 	Login    string `json:"login" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	Scope    string `json:"scope"` /* requested scopes, space-separated */
 }
 
 /* Create a new token (POST /tokens) for a user with credentials in request body {"login":"xxx","password":"yyy"}
+ * checked by the chain of authenticators (see auth.go)
+ * and optional requested scopes {"scope":"tokens:read tokens:delete"}, all the allowed scopes by default
  * no auth
  * 400 -> Wrong parameter
  * 401 -> Wrong credentials
@@ -286,34 +609,24 @@ func TokensPost(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": err.Error()})
 		return
 	}
-
-	var challengeData string = ""
-	if id, err := c.Cookie("ChallengeData"); err == nil {
-		if len(ChallengeData) > 0 {
-			for i := 0; i < len(ChallengeData); i++ {
-				if ChallengeData[i].Id == id {
-					challengeData = ChallengeData[i].Data
-				}
-			}
-		}
-	}
-	if len(challengeData) > 0 {
-		data := fmt.Sprintf("%x", md5.Sum([]byte(tokenUsers[input.Login]+challengeData)))
-		if data != input.Password {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized"})
-			return
-		}
-	} else if tokenUsers[input.Login] != input.Password {
+	roles, source, ok := authenticate(input.Login, input.Password)
+	if !ok {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized"})
 		return
 	}
-	item := GenerateToken(input.Login, c.Request.RemoteAddr)
-	c.SetCookie("ChallengeData", "", -1, "/", tools.Replace(":[0-9]*$", "", c.Request.Host), false, true)
+	scopes := grantScopes(parseScopes(input.Scope), allowedScopes(input.Login, roles))
+	item, err := generateTokens(input.Login, source, clientAddress(c), tools.Genuuid(), scopes, len(source) == 0)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
 	c.SetCookie("Token", tools.StringEncode(item.User, TokenCode)+"-"+item.Token, tokenTTL, "/", tools.Replace(":[0-9]*$", "", c.Request.Host), false, true)
 	c.JSON(http.StatusCreated, item)
 }
 
 /* Create a new token (POST /tokens/auth) for a user with credentials basic auth
+ * checked by the chain of authenticators (see auth.go)
+ * and optional requested scopes in query (?scope=tokens:read), all the allowed scopes by default
  * no auth
  * 204 -> already connected
  * 401 -> Wrong credentials
@@ -322,8 +635,18 @@ func TokensPost(c *gin.Context) {
 func TokensPostAuth(c *gin.Context) {
 	if !TestToken(c) {
 		user, pass, hasAuth := c.Request.BasicAuth()
-		if hasAuth && tokenUsers[user] == pass {
-			item := GenerateToken(user, c.Request.RemoteAddr)
+		var roles []string
+		var source string
+		if hasAuth {
+			roles, source, hasAuth = authenticate(user, pass)
+		}
+		if hasAuth {
+			scopes := grantScopes(parseScopes(c.Query("scope")), allowedScopes(user, roles))
+			item, err := generateTokens(user, source, clientAddress(c), tools.Genuuid(), scopes, len(source) == 0)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+				return
+			}
 			c.SetCookie("Token", tools.StringEncode(item.User, TokenCode)+"-"+item.Token, tokenTTL, "/", tools.Replace(":[0-9]*$", "", c.Request.Host), false, true)
 			c.JSON(http.StatusCreated, item)
 		} else {
@@ -336,35 +659,75 @@ func TokensPostAuth(c *gin.Context) {
 }
 
 /* Clean token (POST /tokens/clean)
- * with auth
+ * with auth, scope tokens:clean
  * 401 -> Unauthorized
+ * 403 -> Missing scope
  * 204 -> Cleaned
  */
 func TokensPostClean(c *gin.Context) {
-	if !TestToken(c) {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "failed", "message": "Unauthorized"})
+	if _, ok := testTokenScope(c, ScopeTokensClean); !ok {
 		return
 	}
 	TokensClean()
 	c.Status(http.StatusNoContent)
 }
 
-/* Function to generate a new token */
-func GenerateToken(user string, RemoteAddr string) TOKEN {
-	id := tools.Genuuid()
-	address := tools.Replace(":[^:]*$", "", RemoteAddr)
+/* Function to generate a new token, random or signed depending on the token format
+ * The store only keeps the keyed hash of the token, the returned item holds the plain token
+ * (and the plain refresh token of a new family, if refresh tokens are enabled)
+ */
+func GenerateToken(user string, RemoteAddr string) (TOKEN, error) {
+	return generateTokens(user, "", RemoteAddr, tools.Genuuid(), allowedScopes(user, userRoles(user)), true)
+}
+
+/* Function to generate a new token for a client (client credentials grant)
+ * The client id is the token user, lifetime (in seconds) replaces the expiration time if not null
+ */
+func GenerateClientToken(client string, lifetime int64, scopes []string, RemoteAddr string) (TOKEN, error) {
+	item := newToken(client, RemoteAddr)
+	item.Client = client
+	item.Lifetime = lifetime
+	item.Scopes = scopes
+	return createToken(item)
+}
+
+/* Initialize the properties of a new token */
+func newToken(user string, RemoteAddr string) TOKEN {
 	now := tools.Epoch()
-	token := tools.Gensha256(id + "/" + strconv.FormatInt(now, 10))
-	item := TOKEN{
-		Id:      id,
+	address, _, err := net.SplitHostPort(RemoteAddr)
+	if err != nil {
+		/* No port, as an address of gin ClientIP (IPv4 or IPv6) */
+		address = RemoteAddr
+	}
+	return TOKEN{
+		Id:      tools.Genuuid(),
 		User:    user,
-		Token:   token,
 		Address: address,
 		Created: now,
 		Updated: now,
 		Hits:    0,
 	}
-	log.Println("Create token " + token + " for user " + user)
-	Tokens = append(Tokens, item)
-	return item
+}
+
+/* Generate the token value of a new token, then save the token */
+func createToken(item TOKEN) (TOKEN, error) {
+	var token string
+	var err error
+	if tokenFormat == "jwt" {
+		token, err = generateJWT(item)
+	} else if tokenFormat == "paseto-local" || tokenFormat == "paseto-public" {
+		token, err = generatePASETO(item, tokenFormat)
+	} else {
+		token, err = tools.SecureRandom(tokenLength, tokenEncoding)
+	}
+	if err != nil {
+		return TOKEN{}, err
+	}
+	item.Token = hashToken(token)
+	if err := store.Create(item); err != nil {
+		return item, err
+	}
+	log.Println("Create token " + item.Id + " for user " + item.User)
+	item.Token = token
+	return item, nil
 }
@@ -0,0 +1,186 @@
+package tokens
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Set a test server secret, the previous one is restored at the end of the test */
+func setTestSecret(t *testing.T) {
+	secret, code := tokenSecret, TokenCode
+	t.Cleanup(func() { tokenSecret, TokenCode = secret, code })
+}
+
+/* The secret is created once, then read again */
+func TestLoadSecret(t *testing.T) {
+	setTestSecret(t)
+	file := filepath.Join(t.TempDir(), "tokens.secret")
+	if err := TokensLoadSecret(file); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Secret file mode %v", info.Mode().Perm())
+	}
+	first := string(tokenSecret)
+	if len(first) != 64 {
+		t.Fatalf("Secret %q", first)
+	}
+	if err = TokensLoadSecret(file); err != nil || string(tokenSecret) != first {
+		t.Fatalf("Secret read again: %q %v", tokenSecret, err)
+	}
+	if err = os.WriteFile(file, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = TokensLoadSecret(file); err == nil {
+		t.Fatal("Empty secret file accepted")
+	}
+}
+
+/* Call a handler with a bearer token and an optional id parameter */
+func callWithToken(t *testing.T, handler gin.HandlerFunc, method, path, token, id string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, path, nil)
+	c.Request.Header.Set("Authorization", "Bearer "+token)
+	if len(id) > 0 {
+		c.Params = gin.Params{{Key: "id", Value: id}}
+	}
+	handler(c)
+	c.Writer.WriteHeaderNow()
+	return w
+}
+
+/* The ids of the tokens listed by GET /tokens */
+func listTokenIds(t *testing.T, token string) map[string]bool {
+	w := callWithToken(t, TokensGet, http.MethodGet, "/tokens", token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /tokens: %d", w.Code)
+	}
+	var list []TOKEN
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool)
+	for _, item := range list {
+		ids[item.Id] = true
+	}
+	return ids
+}
+
+/* A client and a user with the same name do not own each other's tokens */
+func TestTokenOwnershipClient(t *testing.T) {
+	setTestStore(t)
+	scopes := []string{ScopeTokensRead, ScopeTokensDelete}
+	user, err := generateTokens("batch", "", "10.0.0.1", "family", scopes, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := GenerateClientToken("batch", 0, scopes, "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := listTokenIds(t, client.Token); len(ids) != 1 || !ids[client.Id] {
+		t.Fatalf("Tokens of the client: %v", ids)
+	}
+	if ids := listTokenIds(t, user.Token); len(ids) != 1 || !ids[user.Id] {
+		t.Fatalf("Tokens of the user: %v", ids)
+	}
+	if w := callWithToken(t, TokensGetId, http.MethodGet, "/tokens/"+user.Id, client.Token, user.Id); w.Code != http.StatusNotFound {
+		t.Fatalf("Token of the user read by the client: %d", w.Code)
+	}
+	if w := callWithToken(t, TokensDeleteId, http.MethodDelete, "/tokens/"+client.Id, user.Token, client.Id); w.Code != http.StatusNotFound {
+		t.Fatalf("Token of the client deleted by the user: %d", w.Code)
+	}
+	if w := callWithToken(t, TokensDeleteId, http.MethodDelete, "/tokens/"+client.Id, client.Token, client.Id); w.Code != http.StatusNoContent {
+		t.Fatalf("Own token of the client: %d", w.Code)
+	}
+}
+
+/* A user lists only its own tokens and can not clean, an admin lists all the tokens and an operator cleans */
+func TestTokensGetClean(t *testing.T) {
+	s := setTestStore(t)
+	tokens := make(map[string]TOKEN)
+	for _, user := range []struct {
+		login string
+		role  string
+	}{{"alice", RoleUser}, {"bob", RoleUser}, {"root", RoleAdmin}, {"ops", RoleOperator}} {
+		item, err := generateTokens(user.login, "", "10.0.0.1", "family-"+user.login, rolesScopes([]string{user.role}), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[user.login] = item
+	}
+	expired := expiredToken(t, "alice", "")
+
+	if ids := listTokenIds(t, tokens["alice"].Token); len(ids) != 2 || !ids[tokens["alice"].Id] || !ids["alice-expired"] {
+		t.Fatalf("Tokens of alice: %v", ids)
+	}
+	if ids := listTokenIds(t, tokens["root"].Token); len(ids) != 5 {
+		t.Fatalf("Tokens of the admin: %v", ids)
+	}
+	if w := callWithToken(t, TokensGet, http.MethodGet, "/tokens", "unknown", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Unknown token: %d", w.Code)
+	}
+
+	if w := callWithToken(t, TokensPostClean, http.MethodPost, "/tokens/clean", tokens["alice"].Token, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Clean by a user: %d", w.Code)
+	}
+	if _, err := s.GetByValue(hashToken(expired)); err != nil {
+		t.Fatalf("Expired token cleaned by a user: %v", err)
+	}
+	if w := callWithToken(t, TokensPostClean, http.MethodPost, "/tokens/clean", tokens["ops"].Token, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Clean by an operator: %d", w.Code)
+	}
+	if _, err := s.GetByValue(hashToken(expired)); err != ErrNotFound {
+		t.Fatalf("Expired token not cleaned: %v", err)
+	}
+	if ids := listTokenIds(t, tokens["root"].Token); len(ids) != 4 {
+		t.Fatalf("Tokens after the clean: %v", ids)
+	}
+}
+
+/* The client address comes from X-Forwarded-For only for a trusted proxy, without port, IPv6 included */
+func TestClientAddress(t *testing.T) {
+	for _, test := range []struct {
+		trusted   []string
+		remote    string
+		forwarded string
+		address   string
+	}{
+		{nil, "192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{nil, "[2001:db8::1]:1234", "", "2001:db8::1"},
+		{[]string{"192.0.2.0/24"}, "192.0.2.1:1234", "198.51.100.1", "198.51.100.1"},
+		{[]string{"192.0.2.0/24"}, "192.0.2.1:1234", "2001:db8::2", "2001:db8::2"},
+		{[]string{"192.0.2.0/24"}, "203.0.113.1:1234", "198.51.100.1", "203.0.113.1"},
+	} {
+		gin.SetMode(gin.TestMode)
+		c, engine := gin.CreateTestContext(httptest.NewRecorder())
+		if err := engine.SetTrustedProxies(test.trusted); err != nil {
+			t.Fatal(err)
+		}
+		c.Request = httptest.NewRequest(http.MethodPost, "/tokens", nil)
+		c.Request.RemoteAddr = test.remote
+		if len(test.forwarded) > 0 {
+			c.Request.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if address := newToken("alice", clientAddress(c)).Address; address != test.address {
+			t.Fatalf("Address of %s forwarding %s: %s", test.remote, test.forwarded, address)
+		}
+	}
+	for remote, address := range map[string]string{"192.0.2.1:80": "192.0.2.1", "[2001:db8::1]:80": "2001:db8::1", "2001:db8::1": "2001:db8::1", "192.0.2.1": "192.0.2.1"} {
+		if item := newToken("alice", remote); item.Address != address {
+			t.Fatalf("Address of %s: %s", remote, item.Address)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package tokens
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"gotokens/tools"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* The users file, written back on each change made through the users API */
+var usersFile = "users.json"
+
+/* The user properties returned by the users API, without password */
+type USERINFO struct {
+	Login    string   `json:"login"`
+	Name     string   `json:"name,omitempty"`
+	Roles    []string `json:"roles"`
+	Disabled bool     `json:"disabled"`
+}
+
+/* The user input of the users API */
+type INPUTUSER struct {
+	Login    string   `json:"login"`
+	Password string   `json:"password"`
+	Name     *string  `json:"name"`
+	Roles    []string `json:"roles"`
+	Disabled *bool    `json:"disabled"`
+}
+
+func userInfo(login string, user USER) USERINFO {
+	roles := user.Roles
+	if len(roles) == 0 {
+		roles = []string{RoleUser}
+	}
+	return USERINFO{Login: login, Name: user.Name, Roles: roles, Disabled: user.Disabled}
+}
+
+/* Hash a new password as a SCRAM-SHA-256 verifier, so that it can be used by every authentication method
+ * A password already given as a hash is kept as is
+ */
+func hashPassword(password string) (string, error) {
+	if tools.IsPasswordHash(password) {
+		return password, nil
+	}
+	return tools.SCRAMSHA256HashPassword(password, scramIterations)
+}
+
+/* Test if all the roles are known */
+func validRoles(roles []string) bool {
+	for _, role := range roles {
+		if !validRole(role) {
+			return false
+		}
+	}
+	return true
+}
+
+/* Change a user of the users list, tokenUsers must be locked
+ * The changed users of the file are written to the users file (atomically, in the format of the file) first,
+ * the users list is only changed if the file was written
+ * The users added from the command line are not written, unless changed through the users API
+ * - login: the changed user
+ * - user: its new properties, nil if the user is deleted
+ */
+func changeUser(login string, user *USER) error {
+	users := make(map[string]USER, len(tokenUsers.file)+1)
+	for l, u := range tokenUsers.file {
+		users[l] = u
+	}
+	if user != nil {
+		users[login] = *user
+	} else {
+		delete(users, login)
+	}
+	if err := tools.WriteToAllFile(usersFile, users); err != nil {
+		return err
+	}
+	tokenUsers.file = users
+	if user != nil {
+		tokenUsers.users[login] = *user
+	} else {
+		delete(tokenUsers.users, login)
+	}
+	delete(tokenUsers.added, login)
+	return nil
+}
+
+/* Save a changed user to the store if it keeps users
+ * The tokens of a removed or disabled user are revoked if asked (see TokensSetUsersRevoke)
+ * - login: the changed user
+ * - user: its new properties, nil if the user is deleted
+ */
+func saveUser(login string, user *USER) error {
+	if s, ok := store.(UserStore); ok {
+		if user == nil {
+			if err := s.DeleteUser(login); err != nil && err != ErrNotFound {
+				return err
+			}
+		} else if err := s.SaveUser(login, *user); err != nil {
+			return err
+		}
+	}
+	if usersRevoke && (user == nil || user.Disabled) {
+		return revokeUser(login)
+	}
+	return nil
+}
+
+/* Get all the users (GET /tokens/users)
+ * with auth, scope users:manage
+ * 401 -> Unauthorized
+ * 403 -> Missing scope
+ * 200 -> Ok
+ */
+func TokensGetUsers(c *gin.Context) {
+	if _, ok := testTokenScope(c, ScopeUsersManage); !ok {
+		return
+	}
+	list := []USERINFO{}
+	tokenUsers.RLock()
+	for login, user := range tokenUsers.users {
+		list = append(list, userInfo(login, user))
+	}
+	tokenUsers.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Login < list[j].Login })
+	c.JSON(http.StatusOK, list)
+}
+
+/* Get one user (GET /tokens/users/:login)
+ * with auth, scope users:manage
+ * 401 -> Unauthorized
+ * 403 -> Missing scope
+ * 404 -> Not found
+ * 200 -> Ok
+ */
+func TokensGetUser(c *gin.Context) {
+	if _, ok := testTokenScope(c, ScopeUsersManage); !ok {
+		return
+	}
+	login := c.Param("login")
+	user, found := getTokenUser(login)
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": "failed", "message": "Not found"})
+		return
+	}
+	c.JSON(http.StatusOK, userInfo(login, user))
+}
+
+/* Create a user (POST /tokens/users) with {"login":"xxx","password":"yyy","name":"Display Name","roles":["user"]}
+ * with auth, scope users:manage
+ * 400 -> Wrong parameter
+ * 401 -> Unauthorized
+ * 403 -> Missing scope
+ * 409 -> Already exists
+ * 201 -> Created
+ */
+func TokensPostUser(c *gin.Context) {
+	if _, ok := testTokenScope(c, ScopeUsersManage); !ok {
+		return
+	}
+	var input INPUTUSER
+	if err := c.BindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	if len(input.Login) == 0 || len(input.Password) == 0 || !validRoles(input.Roles) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": "Missing login or password, or unknown role"})
+		return
+	}
+	password, err := hashPassword(input.Password)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	user := USER{Password: password, Roles: input.Roles}
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.Disabled != nil {
+		user.Disabled = *input.Disabled
+	}
+	tokenUsers.Lock()
+	if _, found := tokenUsers.users[input.Login]; found {
+		tokenUsers.Unlock()
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"status": "failed", "message": "Already exists"})
+		return
+	}
+	err = changeUser(input.Login, &user)
+	tokenUsers.Unlock()
+	if err == nil {
+		err = saveUser(input.Login, &user)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	log.Println("Create user " + input.Login)
+	c.JSON(http.StatusCreated, userInfo(input.Login, user))
+}
+
+/* Update the name and roles of a user, or disable/enable it (PUT /tokens/users/:login) with {"name":"Display Name","roles":["operator"],"disabled":true}
+ * with auth, scope users:manage
+ * 400 -> Wrong parameter
+ * 401 -> Unauthorized
+ * 403 -> Missing scope
+ * 404 -> Not found
+ * 409 -> A user can not disable itself
+ * 200 -> Updated
+ */
+func TokensPutUser(c *gin.Context) {
+	caller, ok := testTokenScope(c, ScopeUsersManage)
+	if !ok {
+		return
+	}
+	var input INPUTUSER
+	if err := c.BindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	if !validRoles(input.Roles) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": "Unknown role"})
+		return
+	}
+	login := c.Param("login")
+	if login == caller.User && input.Disabled != nil && *input.Disabled {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"status": "failed", "message": "A user can not disable itself"})
+		return
+	}
+	tokenUsers.Lock()
+	user, found := tokenUsers.users[login]
+	if !found {
+		tokenUsers.Unlock()
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": "failed", "message": "Not found"})
+		return
+	}
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.Roles != nil {
+		user.Roles = input.Roles
+	}
+	if input.Disabled != nil {
+		user.Disabled = *input.Disabled
+	}
+	err := changeUser(login, &user)
+	tokenUsers.Unlock()
+	if err == nil {
+		err = saveUser(login, &user)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	log.Println("Update user " + login)
+	c.JSON(http.StatusOK, userInfo(login, user))
+}
+
+/* Reset the password of a user (POST /tokens/users/:login/password) with {"password":"yyy"}
+ * with auth, scope users:manage
+ * 400 -> Wrong parameter
+ * 401 -> Unauthorized
+ * 403 -> Missing scope
+ * 404 -> Not found
+ * 204 -> Password reset
+ */
+func TokensPostUserPassword(c *gin.Context) {
+	if _, ok := testTokenScope(c, ScopeUsersManage); !ok {
+		return
+	}
+	var input INPUTUSER
+	if err := c.BindJSON(&input); err != nil || len(input.Password) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "failed", "message": "Missing password"})
+		return
+	}
+	password, err := hashPassword(input.Password)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	login := c.Param("login")
+	tokenUsers.Lock()
+	user, found := tokenUsers.users[login]
+	if !found {
+		tokenUsers.Unlock()
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": "failed", "message": "Not found"})
+		return
+	}
+	user.Password = password
+	err = changeUser(login, &user)
+	tokenUsers.Unlock()
+	if err == nil {
+		err = saveUser(login, &user)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	log.Println("Reset password of user " + login)
+	c.Status(http.StatusNoContent)
+}
+
+/* Delete a user (DELETE /tokens/users/:login)
+ * with auth, scope users:manage
+ * 401 -> Unauthorized
+ * 403 -> Missing scope
+ * 404 -> Not found
+ * 409 -> A user can not delete itself
+ * 204 -> Deleted
+ */
+func TokensDeleteUser(c *gin.Context) {
+	caller, ok := testTokenScope(c, ScopeUsersManage)
+	if !ok {
+		return
+	}
+	login := c.Param("login")
+	if login == caller.User {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"status": "failed", "message": "A user can not delete itself"})
+		return
+	}
+	tokenUsers.Lock()
+	if _, found := tokenUsers.users[login]; !found {
+		tokenUsers.Unlock()
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": "failed", "message": "Not found"})
+		return
+	}
+	err := changeUser(login, nil)
+	tokenUsers.Unlock()
+	if err == nil {
+		err = saveUser(login, nil)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+		return
+	}
+	log.Println("Delete user " + login)
+	c.Status(http.StatusNoContent)
+}
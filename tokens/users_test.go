@@ -0,0 +1,151 @@
+package tokens
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gotokens/tools"
+)
+
+/* Set a test users list and users file, the previous ones are restored at the end of the test */
+func setTestUsers(t *testing.T, file string, users map[string]USER) {
+	tokenUsers.Lock()
+	previousUsers, previousAdded, previousFileUsers, previousFile := tokenUsers.users, tokenUsers.added, tokenUsers.file, usersFile
+	tokenUsers.users, tokenUsers.added, tokenUsers.file, usersFile = make(map[string]USER), make(map[string]bool), make(map[string]USER), file
+	for login, user := range users {
+		tokenUsers.users[login] = user
+		tokenUsers.file[login] = user
+	}
+	tokenUsers.Unlock()
+	t.Cleanup(func() {
+		tokenUsers.Lock()
+		tokenUsers.users, tokenUsers.added, tokenUsers.file, usersFile = previousUsers, previousAdded, previousFileUsers, previousFile
+		tokenUsers.Unlock()
+	})
+}
+
+/* The users list is not changed when the users file can not be written */
+func TestChangeUserWriteError(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{filepath.Join(dir, "missing", "users.json"), filepath.Join(dir, "missing", "users.ini")} {
+		setTestUsers(t, file, map[string]USER{"alice": {Password: "secret"}})
+		tokenUsers.Lock()
+		errCreate := changeUser("bob", &USER{Password: "secret"})
+		errUpdate := changeUser("alice", &USER{Password: "secret", Disabled: true})
+		errDelete := changeUser("alice", nil)
+		tokenUsers.Unlock()
+		if errCreate == nil || errUpdate == nil || errDelete == nil {
+			t.Fatalf("%s: no write error: %v %v %v", file, errCreate, errUpdate, errDelete)
+		}
+		if _, found := getTokenUser("bob"); found {
+			t.Fatalf("%s: user created without being written", file)
+		}
+		if user, found := getTokenUser("alice"); !found || user.Disabled {
+			t.Fatalf("%s: user changed without being written: %+v %v", file, user, found)
+		}
+	}
+}
+
+func TestChangeUser(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.json")
+	setTestUsers(t, file, map[string]USER{"alice": {Password: "secret"}})
+	AddTokenUser("admin", "pass", RoleAdmin)
+	tokenUsers.Lock()
+	err := changeUser("bob", &USER{Password: "secret", Roles: []string{RoleOperator}})
+	if err == nil {
+		err = changeUser("alice", nil)
+	}
+	tokenUsers.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := getTokenUser("alice"); found {
+		t.Fatal("User not deleted")
+	}
+	users := make(map[string]USER)
+	if err = tools.ReadFromAllFile(file, &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users["bob"].Roles[0] != RoleOperator {
+		t.Fatalf("Users file: %+v", users)
+	}
+}
+
+/* The users file keeps its own record of a login overridden from the command line */
+func TestChangeUserOverridden(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.json")
+	admin := USER{Password: "$2a$10$hash", Roles: []string{RoleAdmin, RoleOperator}, Name: "File admin"}
+	setTestUsers(t, file, map[string]USER{"admin": admin})
+	AddTokenUser("admin", "pass", RoleAdmin)
+	tokenUsers.Lock()
+	err := changeUser("bob", &USER{Password: "secret"})
+	tokenUsers.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make(map[string]USER)
+	if err = tools.ReadFromAllFile(file, &users); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(users["admin"], admin) || len(users) != 2 {
+		t.Fatalf("Users file: %+v", users)
+	}
+	if user, _ := getTokenUser("admin"); user.Password != "pass" {
+		t.Fatalf("Command line user lost: %+v", user)
+	}
+
+	/* A change through the users API ends the override */
+	admin.Name = "API admin"
+	tokenUsers.Lock()
+	err = changeUser("admin", &admin)
+	tokenUsers.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tools.ReadFromAllFile(file, &users); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := getTokenUser("admin"); !reflect.DeepEqual(user, admin) || users["admin"].Name != "API admin" {
+		t.Fatalf("Changed user: %+v, file %+v", user, users)
+	}
+}
+
+/* A users file converted JSON -> YAML -> TOML -> INI -> JSON keeps its users */
+func TestConvertUsers(t *testing.T) {
+	dir := t.TempDir()
+	users := map[string]USER{
+		"alice": {Password: "SCRAM-SHA-256$4096:K68Ae+uOnffMiUTAU0UJIA==$TXpMc8K8IkUQ5mUUGjlx7rHZuAhkRGFfsAYLP6kawQ0=:uDWu6mb0LAbLgnVVVpGAf0vxn/I37zaADpNmm7xcDAw=", Roles: []string{RoleAdmin, RoleOperator}, Name: "Alice Liddell"},
+		"bob":   {Password: "$2a$10$gkQFr.PpMRljjR0y2KmJc.5ZdfiPQQhiwCstJdq54ox2NlYffTHlq"},
+		"carol": {Password: "$argon2id$v=19$m=65536,t=3,p=4$ZLvi7arBKtPdknFG+n2t3A$9jUzyYTnQHJ28hi2t99BqTneAk+yg92Sb6uQ2h54jkA", Roles: []string{RoleUser}, Disabled: true},
+	}
+	input := filepath.Join(dir, "users.json")
+	if err := tools.WriteToAllFile(input, users); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"users.yaml", "users.toml", "users.ini", "back.json"} {
+		output := filepath.Join(dir, name)
+		if err := TokensConvertUsers(input, output); err != nil {
+			t.Fatalf("Convert to %s: %v", name, err)
+		}
+		converted, err := readUsers(output)
+		if err != nil {
+			t.Fatalf("Read %s: %v", name, err)
+		}
+		if !reflect.DeepEqual(converted, users) {
+			t.Fatalf("Users of %s: %+v", name, converted)
+		}
+		input = output
+	}
+
+	/* The TOML file has no blank line but between the users */
+	txt, err := os.ReadFile(filepath.Join(dir, "users.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(txt), "\n\n\n") || strings.HasSuffix(string(txt), "\n\n") || strings.Count(string(txt), "\n\n") != 2 {
+		t.Fatalf("TOML file:\n%s", txt)
+	}
+}
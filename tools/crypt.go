@@ -1,14 +1,22 @@
 package tools
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
 )
 
 func SHA1HashPassword(str string) (string, error) {
@@ -67,3 +75,305 @@ func MD5sum(st string) string {
 func Gensha256(s string) string {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
 }
+
+// Return hex encoded HMAC-SHA256 of string with key
+func HMACSHA256(key []byte, s string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// Check password against a bcrypt hash, raw ($2a$...) or base64 encoded (see BCRYPTHashPassword)
+func BCRYPTCheckPassword(hash, str string) bool {
+	if !strings.HasPrefix(hash, "$2") {
+		if decoded, err := base64.StdEncoding.DecodeString(hash); err == nil {
+			hash = string(decoded)
+		}
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(str)) == nil
+}
+
+// Test if string is a bcrypt hash, raw ($2a$...) or base64 encoded (see BCRYPTHashPassword)
+func IsBCRYPTHash(hash string) bool {
+	if !strings.HasPrefix(hash, "$2") {
+		decoded, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil {
+			return false
+		}
+		hash = string(decoded)
+	}
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// Parameters of the argon2id and scrypt password hashes
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	scryptLogN    = 15
+	scryptR       = 8
+	scryptP       = 1
+	passwordSalt  = 16
+	passwordKey   = 32
+)
+
+// Limits of the parameters of the argon2id and scrypt password hashes checked
+const (
+	argon2MaxMemory = 1 << 22 // 4 GiB, in KiB
+	scryptMaxLogN   = 22
+)
+
+// Return the argon2id hash of a password in PHC format ($argon2id$v=19$m=65536,t=3,p=4$salt$hash)
+func ARGON2IDHashPassword(str string) (string, error) {
+	salt := make([]byte, passwordSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(str), salt, argon2Time, argon2Memory, argon2Threads, passwordKey)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Return the scrypt hash of a password in PHC format ($scrypt$ln=15,r=8,p=1$salt$hash)
+func SCRYPTHashPassword(str string) (string, error) {
+	salt := make([]byte, passwordSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(str), salt, 1<<scryptLogN, scryptR, scryptP, passwordKey)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", scryptLogN, scryptR, scryptP,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Test if string is a password hash with a $id$ prefix: bcrypt ($2a$, $2b$, $2y$), argon2id ($argon2id$) or scrypt ($scrypt$),
+// a SCRAM-SHA-256 verifier (SCRAM-SHA-256$), or a base64 encoded bcrypt hash (see BCRYPTHashPassword)
+func IsPasswordHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$", "$scrypt$", "SCRAM-SHA-256$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return IsBCRYPTHash(hash)
+}
+
+// Check password against a password hash (see IsPasswordHash), in constant time
+func CheckPasswordHash(hash, str string) (bool, error) {
+	if !strings.Contains(hash, "$") && IsBCRYPTHash(hash) {
+		decoded, _ := base64.StdEncoding.DecodeString(hash)
+		hash = string(decoded)
+	}
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(str))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		var version int
+		var memory, time uint32
+		var threads uint8
+		parts := strings.Split(hash, "$")
+		if len(parts) != 6 {
+			return false, errors.New("Wrong argon2id hash")
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+			return false, err
+		}
+		if version != argon2.Version {
+			return false, errors.New("Unsupported argon2 version")
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+			return false, err
+		}
+		if time == 0 || threads == 0 || memory > argon2MaxMemory {
+			return false, errors.New("Wrong argon2id parameters")
+		}
+		salt, key, err := decodeSaltKey(parts[4], parts[5])
+		if err != nil {
+			return false, err
+		}
+		computed := argon2.IDKey([]byte(str), salt, time, memory, threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, computed) == 1, nil
+	case strings.HasPrefix(hash, "$scrypt$"):
+		var logN, r, p int
+		parts := strings.Split(hash, "$")
+		if len(parts) != 5 {
+			return false, errors.New("Wrong scrypt hash")
+		}
+		if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil {
+			return false, err
+		}
+		if logN < 1 || logN > scryptMaxLogN || r < 1 || p < 1 {
+			return false, errors.New("Wrong scrypt parameters")
+		}
+		salt, key, err := decodeSaltKey(parts[3], parts[4])
+		if err != nil {
+			return false, err
+		}
+		computed, err := scrypt.Key([]byte(str), salt, 1<<logN, r, p, len(key))
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare(key, computed) == 1, nil
+	case strings.HasPrefix(hash, "SCRAM-SHA-256$"):
+		salt, iterations, storedKey, _, err := ParseSCRAMSHA256(hash)
+		if err != nil {
+			return false, err
+		}
+		_, computed, _ := SCRAMSHA256Keys(str, salt, iterations)
+		return subtle.ConstantTimeCompare(storedKey, computed) == 1, nil
+	}
+	return false, errors.New("Unknown password hash")
+}
+
+// Decode the base64 salt and key of a PHC hash
+func decodeSaltKey(salt, key string) ([]byte, []byte, error) {
+	s, err := base64.RawStdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	k, err := base64.RawStdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(k) == 0 {
+		return nil, nil, errors.New("Empty password hash key")
+	}
+	return s, k, nil
+}
+
+// Return the SCRAM-SHA-256 keys of a password: salted password, stored key and server key (RFC 5802)
+func SCRAMSHA256Keys(str string, salt []byte, iterations int) ([]byte, []byte, []byte) {
+	salted := pbkdf2.Key([]byte(str), salt, iterations, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return salted, storedKey[:], hmacSHA256(salted, "Server Key")
+}
+
+// Return the SCRAM-SHA-256 verifier of a password (RFC 5803): SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+// The password can not be recovered from it, but a client knowing the password can still prove it with a SCRAM exchange
+func SCRAMSHA256HashPassword(str string, iterations int) (string, error) {
+	salt := make([]byte, passwordSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	_, storedKey, serverKey := SCRAMSHA256Keys(str, salt, iterations)
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", iterations, base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(storedKey), base64.StdEncoding.EncodeToString(serverKey)), nil
+}
+
+// Parse a SCRAM-SHA-256 verifier (see SCRAMSHA256HashPassword), and return its salt, iterations, stored key and server key
+func ParseSCRAMSHA256(hash string) ([]byte, int, []byte, []byte, error) {
+	var iterations int
+	parts := strings.Split(strings.TrimPrefix(hash, "SCRAM-SHA-256$"), "$")
+	if len(parts) != 2 {
+		return nil, 0, nil, nil, errors.New("Wrong SCRAM-SHA-256 hash")
+	}
+	params := strings.SplitN(parts[0], ":", 2)
+	keys := strings.SplitN(parts[1], ":", 2)
+	if len(params) != 2 || len(keys) != 2 {
+		return nil, 0, nil, nil, errors.New("Wrong SCRAM-SHA-256 hash")
+	}
+	if _, err := fmt.Sscanf(params[0], "%d", &iterations); err != nil || iterations <= 0 {
+		return nil, 0, nil, nil, errors.New("Wrong SCRAM-SHA-256 iterations")
+	}
+	var decoded [3][]byte
+	for i, v := range []string{params[1], keys[0], keys[1]} {
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, 0, nil, nil, err
+		}
+		decoded[i] = b
+	}
+	return decoded[0], iterations, decoded[1], decoded[2], nil
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// The alphabet of the crypt(3) base64 encoding
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Hash a password with the Apache MD5 crypt algorithm ($apr1$salt$hash), salt up to 8 characters
+func APR1MD5HashPassword(str, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(str)
+	alt := md5.Sum([]byte(str + salt + str))
+	ctx := md5.New()
+	ctx.Write([]byte(str + "$apr1$" + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alt[:])
+		} else {
+			ctx.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+	var b strings.Builder
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return "$apr1$" + salt + "$" + b.String()
+}
+
+// Check password against an Apache htpasswd hash: bcrypt ($2y$), SHA1 ({SHA}) or Apache MD5 ($apr1$), in constant time
+func CheckHtpasswdHash(hash, str string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return CheckPasswordHash(hash, str)
+	case strings.HasPrefix(hash, "{SHA}"):
+		computed, _ := SHA1HashPassword(str)
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(computed)) == 1, nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.Split(hash, "$")
+		if len(parts) != 4 {
+			return false, errors.New("Wrong APR1 hash")
+		}
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(APR1MD5HashPassword(str, parts[2]))) == 1, nil
+	}
+	return false, errors.New("Unsupported htpasswd hash")
+}
@@ -0,0 +1,62 @@
+package tools
+
+import "testing"
+
+func TestCheckPasswordHash(t *testing.T) {
+	hashers := map[string]func(string) (string, error){
+		"bcrypt":        func(s string) (string, error) { return BCRYPTHashPassword(s, 4) },
+		"argon2id":      ARGON2IDHashPassword,
+		"scrypt":        SCRYPTHashPassword,
+		"scram-sha-256": func(s string) (string, error) { return SCRAMSHA256HashPassword(s, 4096) },
+	}
+	for name, hasher := range hashers {
+		hash, err := hasher("secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsPasswordHash(hash) {
+			t.Fatalf("%s: %s not recognized as a hash", name, hash)
+		}
+		if ok, err := CheckPasswordHash(hash, "secret"); !ok || err != nil {
+			t.Fatalf("%s: right password refused: %v", name, err)
+		}
+		if ok, err := CheckPasswordHash(hash, "wrong"); ok || err != nil {
+			t.Fatalf("%s: wrong password accepted: %v", name, err)
+		}
+	}
+	/* A raw bcrypt hash, as written by htpasswd or other tools */
+	raw := "$2a$10$gkQFr.PpMRljjR0y2KmJc.5ZdfiPQQhiwCstJdq54ox2NlYffTHlq"
+	if !IsPasswordHash(raw) {
+		t.Fatal("Raw bcrypt hash not recognized")
+	}
+	for _, plaintext := range []string{"pass", "secret", "JDJhJDEw"} {
+		if IsPasswordHash(plaintext) {
+			t.Fatalf("Plaintext %s recognized as a hash", plaintext)
+		}
+	}
+	if _, err := CheckPasswordHash("pass", "pass"); err == nil {
+		t.Fatal("No error for an unknown hash")
+	}
+}
+
+/* A malformed hash is refused with an error, never a panic nor a huge allocation */
+func TestCheckPasswordHashMalformed(t *testing.T) {
+	salt, key := "c29tZXNhbHRzb21lc2FsdA", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	for _, hash := range []string{
+		"$argon2id$v=19$m=65536,t=0,p=4$" + salt + "$" + key,
+		"$argon2id$v=19$m=65536,t=3,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=4294967295,t=3,p=4$" + salt + "$" + key,
+		"$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$",
+		"$argon2id$v=16$m=65536,t=3,p=4$" + salt + "$" + key,
+		"$argon2id$v=19$m=65536,t=3$" + salt + "$" + key,
+		"$argon2id$v=19$m=65536,t=3,p=4$" + salt,
+		"$scrypt$ln=0,r=8,p=1$" + salt + "$" + key,
+		"$scrypt$ln=62,r=8,p=1$" + salt + "$" + key,
+		"$scrypt$ln=15,r=0,p=1$" + salt + "$" + key,
+		"$scrypt$ln=15,r=8,p=1$" + salt + "$",
+	} {
+		if ok, err := CheckPasswordHash(hash, "secret"); ok || err == nil {
+			t.Fatalf("Malformed hash %s: %v %v", hash, ok, err)
+		}
+	}
+}
@@ -7,9 +7,13 @@ package tools
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/gookit/ini/v2"
 
@@ -57,7 +61,7 @@ func WriteToJSONFile(file string, data interface{}) error {
 		_, err := os.Stdout.Write(txt)
 		return err
 	}
-	return ioutil.WriteFile(file, txt, 0644)
+	return WriteFileAtomic(file, txt, FileMode(file))
 }
 func WriteToJSONStream(file *os.File, data interface{}) (int, error) {
 	txt, err := json.Marshal(data)
@@ -106,7 +110,7 @@ func WriteToYAMLFile(file string, data interface{}) error {
 		_, err := os.Stdout.Write(txt)
 		return err
 	}
-	return ioutil.WriteFile(file, txt, 0644)
+	return WriteFileAtomic(file, txt, FileMode(file))
 }
 func WriteToYAMLStream(file *os.File, data interface{}) (int, error) {
 	txt, err := yaml.Marshal(data)
@@ -144,10 +148,28 @@ func ReadFromTOML(txt []byte, data interface{}) error {
 	return toml.Unmarshal(txt, data)
 }
 func WriteToTOML(data interface{}) ([]byte, error) {
-	return toml.Marshal(data)
+	txt, err := toml.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	/* The blank lines left by the omitted fields are removed, a blank line is kept before each table */
+	var lines []string
+	for _, line := range strings.Split(string(txt), "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return []byte{}, nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
 }
 func WriteToTOMLFile(file string, data interface{}) error {
-	txt, err := toml.Marshal(data)
+	txt, err := WriteToTOML(data)
 	if err != nil {
 		return errors.New("Can not marshal datas")
 	}
@@ -155,10 +177,10 @@ func WriteToTOMLFile(file string, data interface{}) error {
 		_, err := os.Stdout.Write(txt)
 		return err
 	}
-	return ioutil.WriteFile(file, txt, 0644)
+	return WriteFileAtomic(file, txt, FileMode(file))
 }
 func WriteToTOMLStream(file *os.File, data interface{}) (int, error) {
-	txt, err := toml.Marshal(data)
+	txt, err := WriteToTOML(data)
 	if err != nil {
 		return 0, errors.New("Can not marshal datas")
 	}
@@ -195,22 +217,90 @@ func ReadFromINI(txt []byte, data interface{}) error {
 	return c.MapTo(&data)
 }
 
-/*
 func WriteToINI(data interface{}) ([]byte, error) {
-	return iniv1.Marshal(data)
+	/* The data is read back from JSON: the top-level values are keys of the default section,
+	 * the top-level objects are sections, the arrays are comma-separated lists */
+	txt, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	if err = json.Unmarshal(txt, &values); err != nil {
+		return nil, errors.New("Can not write INI data, it is not an object")
+	}
+	var keys, sections []string
+	for key, value := range values {
+		if _, ok := value.(map[string]interface{}); ok {
+			sections = append(sections, key)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	sort.Strings(sections)
+	var b strings.Builder
+	if err = writeINIKeys(&b, keys, values); err != nil {
+		return nil, err
+	}
+	for _, section := range sections {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString("[" + section + "]\n")
+		fields := values[section].(map[string]interface{})
+		keys = keys[:0]
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if err = writeINIKeys(&b, keys, fields); err != nil {
+			return nil, err
+		}
+	}
+	return []byte(b.String()), nil
+}
+func writeINIKeys(b *strings.Builder, keys []string, values map[string]interface{}) error {
+	for _, key := range keys {
+		var value string
+		switch v := values[key].(type) {
+		case nil:
+			continue
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ",")
+		case map[string]interface{}:
+			return errors.New("Can not write INI data, " + key + " is nested too deep")
+		default:
+			value = fmt.Sprint(v)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return errors.New("Can not write INI data, " + key + " holds a new line")
+		}
+		b.WriteString(key + " = " + value + "\n")
+	}
+	return nil
 }
 func WriteToINIFile(file string, data interface{}) error {
-	txt, err := iniv1.Marshal(data)
-	if err != nil { return errors.New("Can not marshal datas") }
-	if file=="-" { _,err := os.Stdout.Write(txt) ; return err }
-	return ioutil.WriteFile(file, txt, 0644)
+	txt, err := WriteToINI(data)
+	if err != nil {
+		return err
+	}
+	if file == "-" {
+		_, err := os.Stdout.Write(txt)
+		return err
+	}
+	return WriteFileAtomic(file, txt, FileMode(file))
 }
 func WriteToINIStream(file *os.File, data interface{}) (int, error) {
-	txt, err := iniv1.Marshal(data)
-	if err != nil { return 0,errors.New("Can not marshal datas") }
+	txt, err := WriteToINI(data)
+	if err != nil {
+		return 0, err
+	}
 	return file.Write(txt)
 }
-*/
 
 /*
  *  Load/Save in-memory database (insterface) to properties file
@@ -242,7 +332,7 @@ func WriteToPROPSFile(file string, data interface{}) error {
 	txt, err := properties.Marshal(data)
 	if err != nil { return errors.New("Can not marshal datas") }
 	if file=="-" { _,err := os.Stdout.Write(txt) ; return err }
-	return ioutil.WriteFile(file, txt, 0644)
+	return WriteFileAtomic(file, txt, FileMode(file))
 }
 func WriteToPROPSStream(file *os.File, data interface{}) (int, error) {
 	txt, err := properties.Marshal(data)
@@ -277,8 +367,10 @@ func ReadFromAllStream(s io.Reader, data interface{}) error {
  *  - data: the generic structure to load
  */
 func ReadFromAllFile(file string, data interface{}) error {
-	txt, _ := ioutil.ReadFile(file)
-	var err error = nil
+	txt, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
 	if err = json.Unmarshal(txt, data); err != nil {
 		if err = yaml.Unmarshal(txt, data); err != nil {
 			if err = toml.Unmarshal(txt, data); err != nil {
@@ -309,3 +401,62 @@ func ReadFromAll(txt []byte, data interface{}) error {
 	}
 	return err
 }
+
+/*
+ *  Save in-memory database (interface) to file, the format is given by the file extension
+ *  - file: the full path of the file, .yaml or .yml for YAML, .toml for TOML, .ini for INI, JSON otherwise
+ *  - data: the generic structure to save
+ */
+func WriteToAllFile(file string, data interface{}) error {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return WriteToYAMLFile(file, data)
+	case ".toml":
+		return WriteToTOMLFile(file, data)
+	case ".ini":
+		return WriteToINIFile(file, data)
+	}
+	return WriteToJSONFile(file, data)
+}
+
+/*
+ *  The permissions to write a file with: those of the existing file, 0600 for a new file
+ *  so that a file holding secrets is never made readable by others
+ *  - file: the full path of the file
+ */
+func FileMode(file string) os.FileMode {
+	if info, err := os.Stat(file); err == nil {
+		return info.Mode().Perm()
+	}
+	return 0600
+}
+
+/*
+ *  Write a file atomically: the data is written into a temporary file of the same directory,
+ *  then renamed, so that readers see either the old or the new content, never a partial one
+ *  - file: the full path of the file
+ *  - txt: the content
+ *  - perm: the permissions of the file
+ */
+func WriteFileAtomic(file string, txt []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(txt); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,39 @@
+package tools
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/* A new file is written 0600, an existing file keeps its mode */
+func TestWriteToAllFileMode(t *testing.T) {
+	dir := t.TempDir()
+	data := map[string]string{"alice": "secret"}
+	for _, name := range []string{"users.json", "users.yaml", "users.toml", "users.ini"} {
+		file := filepath.Join(dir, name)
+		if err := WriteToAllFile(file, data); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(file); err != nil {
+			t.Fatal(err)
+		} else if info.Mode().Perm() != 0600 {
+			t.Fatalf("Mode of the new file %s: %v", name, info.Mode().Perm())
+		}
+		if err := os.Chmod(file, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteToAllFile(file, data); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(file); err != nil {
+			t.Fatal(err)
+		} else if info.Mode().Perm() != 0640 {
+			t.Fatalf("Mode of the rewritten file %s: %v", name, info.Mode().Perm())
+		}
+		read := make(map[string]string)
+		if err := ReadFromAllFile(file, &read); err != nil || read["alice"] != "secret" {
+			t.Fatalf("Content of %s: %v %v", name, read, err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package tools
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+)
+
+// Return n bytes drawn from crypto/rand, encoded in hex, base64url or base32
+func SecureRandom(n int, encoding string) (string, error) {
+	if n <= 0 {
+		return "", errors.New("Random length must be positive")
+	}
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	switch encoding {
+	case "hex":
+		return hex.EncodeToString(b), nil
+	case "base64url":
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	case "base32":
+		return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+	}
+	return "", errors.New("Unknown random encoding " + encoding)
+}
+
+// Shuffle string using crypto/rand
+func SecureShuffle(input string) (string, error) {
+	inRune := []rune(input)
+	for i := len(inRune) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		inRune[i], inRune[j.Int64()] = inRune[j.Int64()], inRune[i]
+	}
+	return string(inRune), nil
+}
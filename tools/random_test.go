@@ -0,0 +1,119 @@
+package tools
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
+	"testing"
+)
+
+func TestSecureRandomLength(t *testing.T) {
+	for _, n := range []int{1, 5, 16, 32, 33} {
+		for encoding, decode := range map[string]func(string) ([]byte, error){
+			"hex":       hex.DecodeString,
+			"base64url": base64.RawURLEncoding.DecodeString,
+			"base32":    base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString,
+		} {
+			s, err := SecureRandom(n, encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := decode(s)
+			if err != nil {
+				t.Fatalf("%s %q: %v", encoding, s, err)
+			}
+			if len(b) != n {
+				t.Fatalf("%s %q: %d bytes, expected %d", encoding, s, len(b), n)
+			}
+		}
+	}
+	if s, _ := SecureRandom(16, "hex"); len(s) != 32 {
+		t.Fatalf("hex length %d", len(s))
+	}
+	if s, _ := SecureRandom(16, "base64url"); len(s) != 22 {
+		t.Fatalf("base64url length %d", len(s))
+	}
+	if s, _ := SecureRandom(16, "base32"); len(s) != 26 {
+		t.Fatalf("base32 length %d", len(s))
+	}
+}
+
+func TestSecureRandomErrors(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if _, err := SecureRandom(n, "hex"); err == nil {
+			t.Fatalf("No error for length %d", n)
+		}
+	}
+	for _, encoding := range []string{"", "base58", "HEX"} {
+		if _, err := SecureRandom(16, encoding); err == nil {
+			t.Fatalf("No error for encoding %q", encoding)
+		}
+	}
+}
+
+func TestSecureRandomUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		s, err := SecureRandom(16, "base64url")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[s] {
+			t.Fatalf("Duplicate %s after %d draws", s, i)
+		}
+		seen[s] = true
+	}
+}
+
+/* Each byte value is expected 1000 times, the standard deviation is about 31 */
+func TestSecureRandomDistribution(t *testing.T) {
+	s, err := SecureRandom(256*1000, "hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := hex.DecodeString(s)
+	var counts [256]int
+	for _, v := range b {
+		counts[v]++
+	}
+	for v, n := range counts {
+		if n < 800 || n > 1200 {
+			t.Fatalf("Byte %d drawn %d times, expected about 1000", v, n)
+		}
+	}
+}
+
+func TestSecureShuffle(t *testing.T) {
+	input := "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	s, err := SecureShuffle(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := []rune(s)
+	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+	if string(r) != input {
+		t.Fatalf("%s is not a permutation of %s", s, input)
+	}
+	if s, _ = SecureShuffle(""); s != "" {
+		t.Fatalf("Shuffle of an empty string: %q", s)
+	}
+
+	/* The 6 permutations of ABC are expected 1000 times each, the standard deviation is about 29 */
+	counts := make(map[string]int)
+	for i := 0; i < 6000; i++ {
+		s, err := SecureShuffle("ABC")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[s]++
+	}
+	if len(counts) != 6 {
+		t.Fatalf("Permutations: %v", counts)
+	}
+	for p, n := range counts {
+		if n < 800 || n > 1200 {
+			t.Fatalf("Permutation %s drawn %d times, expected about 1000", p, n)
+		}
+	}
+}
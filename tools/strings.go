@@ -3,6 +3,7 @@ package tools
 import (
 	"encoding/base32"
 	"math/rand"
+	"sort"
 	"strings"
 )
 
@@ -41,3 +42,16 @@ func StringDecode(st, code string) (string, error) {
 	}
 	return b, err
 }
+
+/* Shuffle string in an order only depending on key */
+func KeyedShuffle(input, key string) (output string) {
+	inRune := []rune(input)
+	rank := make(map[rune]string)
+	for _, r := range inRune {
+		rank[r] = HMACSHA256([]byte(key), string(r))
+	}
+	sort.SliceStable(inRune, func(i, j int) bool {
+		return rank[inRune[i]] < rank[inRune[j]]
+	})
+	return string(inRune)
+}